@@ -1,10 +1,16 @@
 package commands
 
 import (
+	"fmt"
 	flag "github.com/spf13/pflag"
 	alcubv1beta1 "github.com/yylt/csi-alcub/pkg/api/v1beta1"
+	"github.com/yylt/csi-alcub/pkg/cluster"
+	"github.com/yylt/csi-alcub/pkg/controlrpc"
+	"github.com/yylt/csi-alcub/pkg/manager"
 	"github.com/yylt/csi-alcub/pkg/store"
+	"io/ioutil"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	"strings"
 	"time"
@@ -16,11 +22,28 @@ var (
 	nodename  string
 	leader    = &leaderInfo{}
 	labels    = &labelkv{}
+	webhook   = &webhookInfo{}
+	gcConf    = controlrpc.GCConf{}
+	registry  = &registryInfo{}
+	credInfo  = &credentialInfo{}
 
 	alcubconntimeout time.Duration
 	drivername       string
 	endpoint         string
 	storageIfName    string
+	metricsAddr      string
+	statsInterval    time.Duration
+	cleanInterval    time.Duration
+	cleanTimeout     time.Duration
+	flushTimeout     time.Duration
+	rbdFeatures      string
+	clusterID        string
+	recoverOnStart   bool
+	namespace        string
+	orphanConfigMap  string
+	orphanInterval   time.Duration
+	trashInterval    time.Duration
+	trashConfigMap   string
 )
 
 type labelkv struct {
@@ -29,6 +52,31 @@ type labelkv struct {
 	csilabelkv string
 }
 
+type webhookInfo struct {
+	port     int
+	certdir  string
+	trusted  string
+	accounts string
+}
+
+type credentialInfo struct {
+	secret  string
+	dir     string
+	refresh time.Duration
+
+	authtype  string
+	tokenfile string
+	cafile    string
+	certfile  string
+	keyfile   string
+}
+
+type registryInfo struct {
+	namespace string
+	configmap string
+	refresh   time.Duration
+}
+
 type leaderInfo struct {
 	Id     string
 	enable bool
@@ -38,8 +86,20 @@ func ApplyStore(flagset *flag.FlagSet) {
 	flagset.StringVar(&storeConf.ApiUrl, "alcub-api-url", "", "alcub api url")
 	flagset.StringVar(&storeConf.User, "alcub-user", "", "alucb username")
 	flagset.StringVar(&storeConf.Password, "alcub-password", "", "alcub password")
+	flagset.StringVar(&credInfo.secret, "alcub-secret", "", "secret which include username and password of alcub, format: namespace/name")
+	flagset.StringVar(&credInfo.dir, "alcub-credentials-dir", "", "directory which include username and password files of alcub, usually a mounted secret")
+	flagset.DurationVar(&credInfo.refresh, "alcub-credentials-refresh", 30*time.Second, "interval of reload alcub credentials")
+	flagset.StringVar(&credInfo.authtype, "alcub-auth-type", store.AuthBasicMd5, "alcub authentication, support basic-md5, token and mtls")
+	flagset.StringVar(&credInfo.tokenfile, "alcub-token-file", "", "file which include bearer token, used when auth type is token")
+	flagset.StringVar(&credInfo.cafile, "alcub-ca-file", "", "CA bundle which verify https alcub url, system CAs used when empty")
+	flagset.StringVar(&credInfo.certfile, "alcub-cert-file", "", "client certificate, required when auth type is mtls")
+	flagset.StringVar(&credInfo.keyfile, "alcub-key-file", "", "client certificate key, required when auth type is mtls")
+	_ = flagset.MarkDeprecated("alcub-user", "use --alcub-secret or --alcub-credentials-dir instead")
+	_ = flagset.MarkDeprecated("alcub-password", "use --alcub-secret or --alcub-credentials-dir instead")
 	flagset.StringVar(&storeConf.AlucbPool, "alcub-pool-name", "", "alcub pool name")
 	flagset.DurationVar(&alcubconntimeout, "alcub-conn-timeout", 5*time.Minute, "alcub pool name")
+	flagset.StringVar(&storeConf.ApiVersion, "alcub-api-version", store.ApiVersionAuto, "alcub api version, support auto, v1 and v2, auto negotiate with server")
+	flagset.DurationVar(&storeConf.UrlRefresh, "alcub-url-refresh", 5*time.Minute, "interval of fetch alcub url of node from rados xattr again, disabled when 0")
 }
 
 func ApplyLeaderConf(flagset *flag.FlagSet) {
@@ -47,6 +107,31 @@ func ApplyLeaderConf(flagset *flag.FlagSet) {
 	flagset.BoolVar(&leader.enable, "leader-elect", false, "leader enable")
 }
 
+func ApplyWebhook(flagset *flag.FlagSet) {
+	flagset.IntVar(&webhook.port, "webhook-port", 0, "validating webhook port, disabled when 0")
+	flagset.StringVar(&webhook.certdir, "webhook-cert-dir", "", "directory which include tls.crt and tls.key for webhook")
+	flagset.StringVar(&webhook.trusted, "webhook-trusted-users", "", "users which can update status node and finalizer when attached, split by comma, driver service accounts trusted if empty")
+	flagset.StringVar(&webhook.accounts, "webhook-driver-accounts", "csi-alcub-controller,csi-alcub-node", "service accounts of driver controller and node in the namespace of pod, trusted when --webhook-trusted-users is empty")
+}
+
+func ApplyOrphan(flagset *flag.FlagSet) {
+	flagset.StringVar(&namespace, "namespace", "default", "namespace which the controller running in")
+	flagset.StringVar(&orphanConfigMap, "orphan-configmap", "csi-alcub-orphans", "configmap name which save orphan images to be deleted")
+	flagset.DurationVar(&orphanInterval, "orphan-interval", time.Minute, "interval of retry delete orphan images")
+}
+
+func ApplyTrash(flagset *flag.FlagSet) {
+	flagset.DurationVar(&trashInterval, "trash-purge-interval", time.Hour, "interval of purge expired images in trash, disabled when 0")
+	flagset.StringVar(&trashConfigMap, "trash-configmap", "csi-alcub-trash", "configmap name which record images moved into trash by driver")
+}
+
+func ApplyGC(flagset *flag.FlagSet) {
+	flagset.DurationVar(&gcConf.Interval, "gc-interval", 0, "interval of cross-check rbd images, csialcubs and pvs, disabled when 0")
+	flagset.DurationVar(&gcConf.Grace, "gc-grace", 10*time.Minute, "csialcub created in grace time will not be treated as orphan")
+	flagset.BoolVar(&gcConf.Delete, "gc-delete", false, "delete orphan images and csialcubs, only report if false")
+	flagset.StringVar(&gcConf.ImagePrefix, "gc-image-prefix", "", "optional, only image with prefix will be checked, images are found by driver metadata")
+}
+
 func ApplyLabels(flagset *flag.FlagSet) {
 	flagset.StringVar(&labels.filterkv, "filter-label", "", "filter key-value, support template, now %N replaced by nodename,example: csi-alcub=enable ")
 	flagset.StringVar(&labels.hakv, "ha-maintain-label", "", "when exist, node will not add csi maintain label!,example: hamaintain=enable ")
@@ -62,10 +147,79 @@ func ApplyCsiInfo(flagset *flag.FlagSet) {
 	flagset.StringVar(&drivername, "driver-name", "alcub.csi.es.io", "node name")
 }
 
+func ApplyRbd(flagset *flag.FlagSet) {
+	flagset.StringVar(&rbdFeatures, "rbd-allowed-features", "layering", "rbd image features which alcub client support, split by comma, only checked when image created")
+}
+
+func ApplyCluster(flagset *flag.FlagSet) {
+	flagset.StringVar(&clusterID, "cluster-id", "", "cluster id encoded in volume id, use legacy uuid volume id when empty")
+}
+
+func ApplyRegistry(flagset *flag.FlagSet) {
+	flagset.StringVar(&registry.configmap, "cluster-configmap", "", "configmap which include clusters selected by clusterID of storageclass, only the default cluster is used when empty")
+	flagset.StringVar(&registry.namespace, "cluster-namespace", "default", "namespace of cluster configmap and the default namespace of cluster secrets")
+	flagset.DurationVar(&registry.refresh, "cluster-refresh", time.Minute, "interval of reload cluster configmap and secrets")
+}
+
+func ApplyRecover(flagset *flag.FlagSet) {
+	flagset.BoolVar(&recoverOnStart, "recover-on-start", false, "recreate lost csialcub from pv and rbd image metadata when controller started")
+}
+
+func ApplyMetrics(flagset *flag.FlagSet) {
+	flagset.StringVar(&metricsAddr, "metrics-bind-address", "0", "address of prometheus metrics, disabled when 0")
+}
+
+func ApplyStats(flagset *flag.FlagSet) {
+	flagset.DurationVar(&statsInterval, "cache-stats-interval", 30*time.Second, "interval of query cache statistics of attached volumes, disabled when 0")
+}
+
+func ApplyWaitClean(flagset *flag.FlagSet) {
+	flagset.DurationVar(&cleanInterval, "image-clean-interval", 2*time.Second, "interval of poll image status before attach")
+	flagset.DurationVar(&cleanTimeout, "image-clean-timeout", time.Minute, "max wait of image clean before attach, should be less than rpc timeout of kubelet")
+	flagset.DurationVar(&flushTimeout, "flush-timeout", time.Minute, "max wait of cache flush before detach, flush is not sent and wait image clean by --image-clean-timeout when 0")
+}
+
 func ApplyStorageIfName(flagset *flag.FlagSet) {
 	flagset.StringVar(&storageIfName, "storage-if-name", "", "storage net interface name")
 }
 
+// set credential and authentication of store configure,
+// the deprecated flags are used if credential not defined
+func setupCredential(client kubernetes.Interface) error {
+	switch {
+	case credInfo.secret != "" && credInfo.dir != "":
+		return fmt.Errorf("only one of --alcub-secret and --alcub-credentials-dir can be defined")
+	case credInfo.secret != "":
+		ss := strings.Split(credInfo.secret, "/")
+		if len(ss) != 2 || ss[0] == "" || ss[1] == "" {
+			return fmt.Errorf("invalid --alcub-secret %s, format is namespace/name", credInfo.secret)
+		}
+		storeConf.Credential = store.NewSecretCredential(client, ss[0], ss[1], credInfo.refresh)
+	case credInfo.dir != "":
+		storeConf.Credential = store.NewFileCredential(credInfo.dir, credInfo.refresh)
+	}
+	tlsconf, err := store.NewTLSConfig(credInfo.cafile, credInfo.certfile, credInfo.keyfile)
+	if err != nil {
+		return err
+	}
+	storeConf.TLSConfig = tlsconf
+	if credInfo.authtype != store.AuthBasicMd5 {
+		storeConf.Auth, err = store.NewAuthenticator(credInfo.authtype, storeConf.Credential, credInfo.tokenfile, credInfo.refresh, tlsconf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// return nil if cluster configmap not defined
+func newRegistry(client kubernetes.Interface) *cluster.Registry {
+	if registry.configmap == "" {
+		return nil
+	}
+	return cluster.NewRegistry(client, registry.namespace, registry.configmap, registry.refresh)
+}
+
 func init() {
 	_ = clientgoscheme.AddToScheme(scheme)
 
@@ -80,3 +234,30 @@ func splitLabel(s string) map[string]string {
 	}
 	return map[string]string{ss[0]: ss[1]}
 }
+
+// namespace of pod, which is mounted with service account token
+const podNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// trustedUsers return users from flag, or driver service accounts if empty
+func trustedUsers() ([]string, error) {
+	var users []string
+	for _, u := range strings.Split(webhook.trusted, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			users = append(users, u)
+		}
+	}
+	if len(users) > 0 {
+		return users, nil
+	}
+	b, err := ioutil.ReadFile(podNamespaceFile)
+	if err != nil {
+		return nil, fmt.Errorf("read namespace of driver service accounts failed: %v", err)
+	}
+	ns := strings.TrimSpace(string(b))
+	for _, sa := range strings.Split(webhook.accounts, ",") {
+		if sa = strings.TrimSpace(sa); sa != "" {
+			users = append(users, manager.ServiceAccountUser(ns, sa))
+		}
+	}
+	return users, nil
+}
@@ -2,6 +2,7 @@ package commands
 
 import (
 	"os"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -33,6 +34,8 @@ func NewControllerCmd() *cobra.Command {
 				LeaderElection:   leader.enable,
 				LeaderElectionID: leader.Id,
 				Scheme:           scheme,
+				Port:             webhook.port,
+				CertDir:          webhook.certdir,
 			})
 			if err != nil {
 				klog.Error(err, "unable to set up overall controller manager")
@@ -40,8 +43,20 @@ func NewControllerCmd() *cobra.Command {
 			}
 
 			alcubcon := manager.NewAlcubCon(mgr)
+			if webhook.port > 0 {
+				users, err := trustedUsers()
+				if err != nil {
+					return err
+				}
+				manager.NewAlcubValidator(mgr, users)
+			}
 
+			err = setupCredential(client)
+			if err != nil {
+				return err
+			}
 			s := store.NewClient(&storeConf, nil, alcubconntimeout)
+			s.SetupSecrets(client, credInfo.refresh)
 
 			hamap := splitLabel(labels.hakv)
 			csimap := splitLabel(labels.csilabelkv)
@@ -52,13 +67,47 @@ func NewControllerCmd() *cobra.Command {
 			}
 
 			rbd := rbd2.NewRbd(client, time.Second*10)
-			csiController := controlrpc.NewController(nodename, s, alcubcon, rbd)
+			err = rbd.SetAllowedFeatures(strings.Split(rbdFeatures, ","))
+			if err != nil {
+				return err
+			}
+			csiController := controlrpc.NewController(nodename, client, s, alcubcon, rbd)
 
 			nodemanager, err := controlrpc.NewNode(mgr, csiController, filterkey, filtervalue, hamap, csimap)
 			if err != nil {
 				return err
 			}
 			csiController.SetupNode(nodemanager)
+			csiController.SetupClusterId(clusterID)
+			if r := newRegistry(client); r != nil {
+				csiController.SetupRegistry(r)
+				rbd.SetupRegistry(r)
+			}
+			orphanQueue, err := controlrpc.NewOrphanQueue(mgr, client, rbd, namespace, orphanConfigMap, orphanInterval)
+			if err != nil {
+				return err
+			}
+			csiController.SetupOrphan(orphanQueue)
+			trashPurger, err := controlrpc.NewTrashPurger(mgr, client, rbd, namespace, trashConfigMap, trashInterval)
+			if err != nil {
+				return err
+			}
+			csiController.SetupTrash(trashPurger)
+			if recoverOnStart {
+				err = controlrpc.NewRecoverRunner(mgr, rbd, drivername, clusterID)
+				if err != nil {
+					return err
+				}
+			}
+			if gcConf.Interval > 0 {
+				gcConf.Drivername = drivername
+				gcConf.ClusterId = clusterID
+				_, err = controlrpc.NewGC(mgr, alcubcon, rbd, orphanQueue, gcConf)
+				if err != nil {
+					return err
+				}
+			}
+			alcubcon.SetupDeleter(csiController.DeleteImage)
 			csiIdentify, err := server.NewIdenty(drivername, server.ControllerCapability())
 			if err != nil {
 				return err
@@ -83,6 +132,14 @@ func NewControllerCmd() *cobra.Command {
 	ApplyNode(flagset)
 	ApplyLeaderConf(flagset)
 	ApplyCsiInfo(flagset)
+	ApplyWebhook(flagset)
+	ApplyOrphan(flagset)
+	ApplyGC(flagset)
+	ApplyTrash(flagset)
+	ApplyRbd(flagset)
+	ApplyCluster(flagset)
+	ApplyRecover(flagset)
+	ApplyRegistry(flagset)
 
 	return cmd
 }
@@ -30,7 +30,7 @@ func NewNodeCmd() *cobra.Command {
 
 			mgr, err := ctrl.NewManager(kubeconfg, ctrl.Options{
 				Scheme:             scheme,
-				MetricsBindAddress: "0",
+				MetricsBindAddress: metricsAddr,
 			})
 			if err != nil {
 				klog.Error(err, "unable to set up overall controller manager")
@@ -42,10 +42,28 @@ func NewNodeCmd() *cobra.Command {
 			)
 			storeDynConf.Nodename = nodename
 
+			err = setupCredential(client)
+			if err != nil {
+				return err
+			}
 			s := store.NewClient(&storeConf, &storeDynConf, alcubconntimeout)
+			s.SetupSecrets(client, credInfo.refresh)
 			rbd := rbd2.NewRbd(client, time.Second*5)
 
 			csiNode := noderpc.NewNode(s, alcubcon, rbd, nodename, storageIfName)
+			csiNode.SetupWaitClean(cleanInterval, cleanTimeout)
+			csiNode.SetupFlush(flushTimeout)
+			csiNode.SetupKubeClient(client)
+			if r := newRegistry(client); r != nil {
+				csiNode.SetupRegistry(r)
+			}
+
+			if metricsAddr != "0" && statsInterval > 0 {
+				_, err = noderpc.NewStats(mgr, csiNode, statsInterval)
+				if err != nil {
+					return err
+				}
+			}
 
 			csiIdentify, err := server.NewIdenty(drivername, server.ConstraCapability())
 			if err != nil {
@@ -70,6 +88,10 @@ func NewNodeCmd() *cobra.Command {
 	ApplyNode(flagset)
 	ApplyCsiInfo(flagset)
 	ApplyStorageIfName(flagset)
+	ApplyRegistry(flagset)
+	ApplyMetrics(flagset)
+	ApplyStats(flagset)
+	ApplyWaitClean(flagset)
 
 	return cmd
 }
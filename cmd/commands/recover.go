@@ -0,0 +1,55 @@
+package commands
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/yylt/csi-alcub/pkg/controlrpc"
+	rbd2 "github.com/yylt/csi-alcub/pkg/rbd"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+func NewRecoverCmd() *cobra.Command {
+	var (
+		dryrun bool
+	)
+	var cmd = &cobra.Command{
+		Use:   "recover",
+		Short: "recreate csialcub from pv and rbd image metadata",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+			kubeconfg := config.GetConfigOrDie()
+			cli, err := client.New(kubeconfg, client.Options{Scheme: scheme})
+			if err != nil {
+				return err
+			}
+			kubecli := kubernetes.NewForConfigOrDie(kubeconfg)
+			rbd := rbd2.NewRbd(kubecli, time.Second*30)
+			if r := newRegistry(kubecli); r != nil {
+				rbd.SetupRegistry(r)
+			}
+			rc := controlrpc.NewRecover(cli, rbd, drivername, clusterID)
+			items, err := rc.Plan(ctx)
+			if err != nil {
+				return err
+			}
+			err = controlrpc.PrintRecover(os.Stdout, items)
+			if err != nil || dryrun {
+				return err
+			}
+			return rc.Apply(ctx, items)
+		},
+	}
+	flagset := cmd.PersistentFlags()
+	flagset.BoolVar(&dryrun, "dry-run", false, "only print the diff, nothing changed")
+
+	ApplyCsiInfo(flagset)
+	ApplyCluster(flagset)
+	ApplyRegistry(flagset)
+
+	return cmd
+}
@@ -0,0 +1,115 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/yylt/csi-alcub/pkg/controlrpc"
+	rbd2 "github.com/yylt/csi-alcub/pkg/rbd"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sigs.k8s.io/yaml"
+)
+
+func NewStateCmd() *cobra.Command {
+	var (
+		file   string
+		output string
+		dryrun bool
+	)
+	var cmd = &cobra.Command{
+		Use:   "state",
+		Short: "export and import csialcub state for cluster migration",
+	}
+	flagset := cmd.PersistentFlags()
+	flagset.StringVarP(&file, "file", "f", "", "bundle file path, stdout/stdin when empty")
+
+	exportcmd := &cobra.Command{
+		Use:   "export",
+		Short: "export csialcubs and pvs into bundle",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			state, err := newState()
+			if err != nil {
+				return err
+			}
+			bundle, err := state.Export(context.Background())
+			if err != nil {
+				return err
+			}
+			var data []byte
+			switch output {
+			case "json":
+				data, err = json.MarshalIndent(bundle, "", "  ")
+			case "yaml":
+				data, err = yaml.Marshal(bundle)
+			default:
+				return fmt.Errorf("unsupported output format %s", output)
+			}
+			if err != nil {
+				return err
+			}
+			if file == "" {
+				_, err = os.Stdout.Write(data)
+				return err
+			}
+			return ioutil.WriteFile(file, data, 0600)
+		},
+	}
+	exportcmd.Flags().StringVarP(&output, "output", "o", "yaml", "bundle format, json or yaml")
+
+	importcmd := &cobra.Command{
+		Use:   "import",
+		Short: "import csialcubs and static pvs from bundle",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var (
+				data   []byte
+				err    error
+				bundle controlrpc.StateBundle
+			)
+			if file == "" {
+				data, err = ioutil.ReadAll(os.Stdin)
+			} else {
+				data, err = ioutil.ReadFile(file)
+			}
+			if err != nil {
+				return err
+			}
+			// yaml is superset of json
+			err = yaml.Unmarshal(data, &bundle)
+			if err != nil {
+				return err
+			}
+			state, err := newState()
+			if err != nil {
+				return err
+			}
+			return state.Import(context.Background(), &bundle, dryrun)
+		},
+	}
+	importcmd.Flags().BoolVar(&dryrun, "dry-run", false, "only check images, nothing created")
+
+	cmd.AddCommand(exportcmd, importcmd)
+	ApplyCsiInfo(flagset)
+	ApplyRegistry(flagset)
+	return cmd
+}
+
+func newState() (*controlrpc.State, error) {
+	kubeconfg := config.GetConfigOrDie()
+	cli, err := client.New(kubeconfg, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+	kubecli := kubernetes.NewForConfigOrDie(kubeconfg)
+	rbd := rbd2.NewRbd(kubecli, time.Second*30)
+	if r := newRegistry(kubecli); r != nil {
+		rbd.SetupRegistry(r)
+	}
+	return controlrpc.NewState(cli, rbd, drivername), nil
+}
@@ -0,0 +1,200 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/spf13/cobra"
+	alcubv1beta1 "github.com/yylt/csi-alcub/pkg/api/v1beta1"
+	"github.com/yylt/csi-alcub/pkg/controlrpc"
+	"github.com/yylt/csi-alcub/pkg/manager"
+	rbd2 "github.com/yylt/csi-alcub/pkg/rbd"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	klog "k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+type trashInfo struct {
+	rbdsc         string
+	clusterid     string
+	id            string
+	image         string
+	pvname        string
+	storageclass  string
+	fstype        string
+	reclaimPolicy string
+}
+
+func NewTrashCmd() *cobra.Command {
+	var (
+		info = &trashInfo{}
+	)
+	var cmd = &cobra.Command{
+		Use:   "trash",
+		Short: "list and restore rbd images in trash",
+	}
+	flagset := cmd.PersistentFlags()
+	flagset.StringVar(&info.rbdsc, "rbd-sc", "", "rbd storage class which fetch rbd params")
+	flagset.StringVar(&info.clusterid, "cluster-id", "", "cluster in registry which include the trash, default cluster is used when empty")
+
+	listcmd := &cobra.Command{
+		Use:   "list",
+		Short: "list rbd images in trash",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client := kubernetes.NewForConfigOrDie(config.GetConfigOrDie())
+			rbd, err := trashRbd(client, info)
+			if err != nil {
+				return err
+			}
+			pool, entries, err := rbd.TrashList(info.rbdsc)
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "POOL\tID\tNAME\tDELETED\tSTATUS")
+			for _, e := range entries {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", pool, e.Id, e.Name, e.DeletedAt, e.Status)
+			}
+			return w.Flush()
+		},
+	}
+
+	restorecmd := &cobra.Command{
+		Use:   "restore",
+		Short: "restore rbd image from trash into a new pv",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return restoreTrash(info)
+		},
+	}
+	restoreflag := restorecmd.Flags()
+	restoreflag.StringVar(&info.id, "id", "", "image id in trash")
+	restoreflag.StringVar(&info.image, "image", "", "new image name")
+	restoreflag.StringVar(&info.pvname, "pv-name", "", "new pv name, also used as csialcub name")
+	restoreflag.StringVar(&info.storageclass, "storage-class", "", "storage class name of new pv")
+	restoreflag.StringVar(&info.fstype, "fs-type", "ext4", "fs type of new pv")
+	restoreflag.StringVar(&info.reclaimPolicy, "reclaim-policy", string(corev1.PersistentVolumeReclaimRetain), "reclaim policy of new pv")
+
+	cmd.AddCommand(listcmd, restorecmd)
+	ApplyCsiInfo(flagset)
+	ApplyRegistry(flagset)
+	return cmd
+}
+
+// rbd of the cluster which include the trash
+func trashRbd(client kubernetes.Interface, info *trashInfo) (*rbd2.Rbd, error) {
+	rbd := rbd2.NewRbd(client, time.Second*30)
+	if info.clusterid == "" {
+		return rbd, nil
+	}
+	r := newRegistry(client)
+	if r == nil {
+		return nil, fmt.Errorf("cluster-configmap must be defined when cluster-id is not empty")
+	}
+	rbd.SetupRegistry(r)
+	return rbd.Cluster(info.clusterid)
+}
+
+// restore image, and create csialcub and pv
+func restoreTrash(info *trashInfo) error {
+	if info.rbdsc == "" || info.id == "" || info.image == "" || info.pvname == "" {
+		return fmt.Errorf("rbd-sc, id, image and pv-name must not be empty")
+	}
+	ctx := context.Background()
+	kubeconfg := config.GetConfigOrDie()
+	kubecli := kubernetes.NewForConfigOrDie(kubeconfg)
+	cli, err := client.New(kubeconfg, client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+
+	rbd, err := trashRbd(kubecli, info)
+	if err != nil {
+		return err
+	}
+	volume, size, err := rbd.TrashRestore(info.rbdsc, info.id, info.image)
+	if err != nil {
+		return err
+	}
+	klog.Infof("restore image %s/%s success, size: %d", volume.Pool, volume.Image, size)
+
+	// settings of the deleted volume are recorded in image metadata
+	meta, err := rbd.GetImageMeta(info.rbdsc, volume.Image)
+	if err != nil {
+		return err
+	}
+	clusterid := info.clusterid
+	if v := meta[controlrpc.MetaClusterId]; v != "" {
+		if clusterid != "" && clusterid != v {
+			return fmt.Errorf("image %s belongs to cluster %s, but restored in cluster %s", volume.Image, v, clusterid)
+		}
+		clusterid = v
+	}
+	volumeID := uuid.NewUUID().String()
+	spec := &alcubv1beta1.CsiAlcubSpec{
+		Uuid:      volumeID,
+		Capacity:  size,
+		RbdSc:     info.rbdsc,
+		Pool:      volume.Pool,
+		Image:     volume.Image,
+		PvName:    info.pvname,
+		ClusterId: clusterid,
+	}
+	err = controlrpc.RestoreSettings(spec, meta)
+	if err != nil {
+		return err
+	}
+	klog.Infof("restore csialcub %s with delete policy %s, cluster: %s", info.pvname, spec.DeletePolicy, clusterid)
+	err = rbd.SetImageMeta(info.rbdsc, volume.Image, map[string]string{
+		controlrpc.MetaVolumeId: volumeID,
+		controlrpc.MetaPvName:   info.pvname,
+	})
+	if err != nil {
+		klog.Warningf("set image %s metadata failed: %v", volume.Image, err)
+	}
+	err = cli.Create(ctx, manager.NewCsiAlcub(info.pvname, spec))
+	if err != nil {
+		return err
+	}
+
+	attrs := map[string]string{
+		"scname": info.rbdsc,
+	}
+	if clusterid != "" {
+		attrs["clusterID"] = clusterid
+	}
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: info.pvname,
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			Capacity: corev1.ResourceList{
+				corev1.ResourceStorage: *resource.NewQuantity(size, resource.BinarySI),
+			},
+			AccessModes:                   []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimPolicy(info.reclaimPolicy),
+			StorageClassName:              info.storageclass,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:           drivername,
+					VolumeHandle:     volumeID,
+					FSType:           info.fstype,
+					VolumeAttributes: attrs,
+				},
+			},
+		},
+	}
+	err = cli.Create(ctx, pv)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("pv %s created, volumeHandle: %s\n", info.pvname, volumeID)
+	return nil
+}
@@ -30,6 +30,9 @@ func rootCmd() *cobra.Command {
 	rootc.AddCommand(
 		commands.NewControllerCmd(),
 		commands.NewNodeCmd(),
+		commands.NewTrashCmd(),
+		commands.NewRecoverCmd(),
+		commands.NewStateCmd(),
 	)
 
 	return rootc
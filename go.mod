@@ -7,6 +7,7 @@ require (
 	github.com/imroc/req v0.3.0
 	github.com/kubernetes-csi/csi-lib-utils v0.9.0
 	github.com/pborman/uuid v1.2.0
+	github.com/prometheus/client_golang v1.7.1
 	github.com/spf13/cobra v1.1.1
 	github.com/spf13/pflag v1.0.5
 	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b
@@ -19,6 +20,7 @@ require (
 	k8s.io/utils v0.0.0-20201110183641-67b214c5f920
 	sigs.k8s.io/controller-runtime v0.7.0
 	sigs.k8s.io/sig-storage-lib-external-provisioner/v6 v6.1.0
+	sigs.k8s.io/yaml v1.2.0
 )
 
 replace k8s.io/api => k8s.io/api v0.19.4
@@ -13,14 +13,70 @@ type CsiAlcubSpec struct {
 	// if not use alcub, pls add more param.
 	Pool  string `json:"rbd_pool"`
 	Image string `json:"rbd_image"`
+	// cluster in registry, empty means the default cluster
+	ClusterId string `json:"clusterID,omitempty"`
+	// override alcub flags of driver, nil means use flags
+	Alcub *AlcubSettings `json:"alcub,omitempty"`
+	// cache policy of device, nil means alcub default
+	Cache *CachePolicy `json:"cache,omitempty"`
+
+	// filled when provisioner enable extra-create-metadata
+	PvName       string `json:"pvName,omitempty"`
+	PvcName      string `json:"pvcName,omitempty"`
+	PvcNamespace string `json:"pvcNamespace,omitempty"`
+
+	// delete, trash or retain, default is delete
+	DeletePolicy string `json:"deletePolicy,omitempty"`
+	// image in trash can be purged after deferment
+	TrashDeferment metav1.Duration `json:"trashDeferment,omitempty"`
+}
+
+// alcub settings from storageclass parameters, empty field means use flag
+type AlcubSettings struct {
+	Pool   string `json:"pool,omitempty"`
+	ApiUrl string `json:"apiUrl,omitempty"`
+	// secret which include username and password, resolved when used
+	SecretName      string `json:"secretName,omitempty"`
+	SecretNamespace string `json:"secretNamespace,omitempty"`
+}
+
+// mode of alcub cache
+const (
+	CacheModeWriteBack    = "writeback"
+	CacheModeWriteThrough = "writethrough"
+)
+
+// cache policy from storageclass parameters
+type CachePolicy struct {
+	Mode string `json:"mode,omitempty"`
+	// reserved cache size in bytes, 0 means alcub default
+	Size int64 `json:"size,omitempty"`
+	// 1 to 10, higher is kept longer in cache, 0 means alcub default
+	Priority int32 `json:"priority,omitempty"`
 }
 
+// policy of rbd image when volume deleted
+const (
+	DeletePolicyDelete = "delete"
+	DeletePolicyTrash  = "trash"
+	// image is kept when volume deleted
+	DeletePolicyRetain = "retain"
+)
+
 type VolumeInfo struct {
 	//dev path, such as /dev/rbd1 .etc
 	Devpath   string `json:"devpath,omitempty"`
 	StorageIp string `json:"storageip,omitempty"`
 }
 
+// phase of deleting, set by finalizer
+const (
+	// wait the volume detached from node
+	PhaseWaitDetach = "WaitDetach"
+	// detached, and the rbd image is deleting
+	PhaseDeleting = "Deleting"
+)
+
 type CsiAlcubStatus struct {
 	VolumeInfo VolumeInfo `json:"volumeInfo,omitempty"`
 
@@ -30,14 +86,25 @@ type CsiAlcubStatus struct {
 	// fill in the node which is now use the volume
 	Node     string   `json:"node,omitempty"`
 	AllNodes []string `json:"zone,omitempty"`
+
+	// deleting phase, empty when not deleting
+	Phase string `json:"phase,omitempty"`
+
+	// progress of attaching, such as waiting for cache flush
+	Message string `json:"message,omitempty"`
 }
 
 // +kubebuilder:resource:scope=Cluster
 // +kubebuilder:object:root=true
+// +kubebuilder:printcolumn:JSONPath=.spec.pvcNamespace,name="Namespace",type=string
+// +kubebuilder:printcolumn:JSONPath=.spec.pvcName,name="PVC",type=string
+// +kubebuilder:printcolumn:JSONPath=.spec.pvName,name="PV",type=string
 // +kubebuilder:printcolumn:JSONPath=.status.node,name="Node",type=string
 // +kubebuilder:printcolumn:JSONPath=.status.prenode,name="PreNode",type=string
 // +kubebuilder:printcolumn:JSONPath=.status.volumeInfo.devpath,name="Dev",type=string
 // +kubebuilder:printcolumn:JSONPath=.status.volumeInfo.storageip,name="StorageIp",type=string
+// +kubebuilder:printcolumn:JSONPath=.status.phase,name="Phase",type=string
+// +kubebuilder:printcolumn:JSONPath=.status.message,name="Message",type=string,priority=1
 type CsiAlcub struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
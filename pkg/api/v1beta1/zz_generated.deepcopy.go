@@ -1,4 +1,4 @@
-// +build !ignore_autogenerated
+//go:build !ignore_autogenerated
 
 // Code generated by controller-gen. DO NOT EDIT.
 
@@ -8,12 +8,42 @@ import (
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AlcubSettings) DeepCopyInto(out *AlcubSettings) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AlcubSettings.
+func (in *AlcubSettings) DeepCopy() *AlcubSettings {
+	if in == nil {
+		return nil
+	}
+	out := new(AlcubSettings)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CachePolicy) DeepCopyInto(out *CachePolicy) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CachePolicy.
+func (in *CachePolicy) DeepCopy() *CachePolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(CachePolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CsiAlcub) DeepCopyInto(out *CsiAlcub) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
+	in.Spec.DeepCopyInto(&out.Spec)
 	in.Status.DeepCopyInto(&out.Status)
 }
 
@@ -70,6 +100,17 @@ func (in *CsiAlcubList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CsiAlcubSpec) DeepCopyInto(out *CsiAlcubSpec) {
 	*out = *in
+	if in.Alcub != nil {
+		in, out := &in.Alcub, &out.Alcub
+		*out = new(AlcubSettings)
+		**out = **in
+	}
+	if in.Cache != nil {
+		in, out := &in.Cache, &out.Cache
+		*out = new(CachePolicy)
+		**out = **in
+	}
+	out.TrashDeferment = in.TrashDeferment
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CsiAlcubSpec.
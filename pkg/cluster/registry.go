@@ -0,0 +1,131 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	// key in configmap, value is json array of Cluster
+	configKey = "config.json"
+	// key in secret
+	secretKeyName = "key"
+
+	defaultUserId = "admin"
+)
+
+// Cluster is ceph and alcub cluster which selected by clusterID
+type Cluster struct {
+	ClusterId string   `json:"clusterID"`
+	Monitors  []string `json:"monitors"`
+	// pool which include alcubierre_node_{node} xattr
+	AlcubPool string `json:"alcubPool"`
+	UserId    string `json:"userID,omitempty"`
+	// secret which include ceph key of user
+	SecretName      string `json:"secretName"`
+	SecretNamespace string `json:"secretNamespace,omitempty"`
+
+	// load from secret
+	Key string `json:"-"`
+}
+
+// Registry load clusters from configmap and secrets,
+// and reload when cache expired, so cluster can be added without restart
+type Registry struct {
+	ctx       context.Context
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	ttl       time.Duration
+
+	mu       sync.Mutex
+	loadtime time.Time
+	clusters map[string]*Cluster
+}
+
+func NewRegistry(client kubernetes.Interface, namespace, name string, ttl time.Duration) *Registry {
+	return &Registry{
+		ctx:       context.Background(),
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		ttl:       ttl,
+		clusters:  map[string]*Cluster{},
+	}
+}
+
+// Get return cluster by id, reload when not found or cache expired
+func (r *Registry) Get(id string) (*Cluster, error) {
+	if id == "" {
+		return nil, fmt.Errorf("cluster id must not be empty")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cl, ok := r.clusters[id]
+	if ok && time.Since(r.loadtime) < r.ttl {
+		return cl, nil
+	}
+	err := r.load()
+	if err != nil {
+		if ok {
+			klog.Errorf("reload cluster registry failed, use cached: %v", err)
+			return cl, nil
+		}
+		return nil, err
+	}
+	cl, ok = r.clusters[id]
+	if !ok {
+		return nil, fmt.Errorf("cluster %s not found in configmap %s/%s", id, r.namespace, r.name)
+	}
+	return cl, nil
+}
+
+func (r *Registry) load() error {
+	var (
+		list     []*Cluster
+		clusters = map[string]*Cluster{}
+	)
+	cm, err := r.client.CoreV1().ConfigMaps(r.namespace).Get(r.ctx, r.name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal([]byte(cm.Data[configKey]), &list)
+	if err != nil {
+		return fmt.Errorf("parse %s in configmap %s/%s failed: %v", configKey, r.namespace, r.name, err)
+	}
+	for _, cl := range list {
+		if cl.ClusterId == "" || len(cl.Monitors) == 0 || cl.SecretName == "" {
+			klog.Errorf("invalid cluster %s: clusterID, monitors and secretName are required", cl.ClusterId)
+			continue
+		}
+		if cl.UserId == "" {
+			cl.UserId = defaultUserId
+		}
+		if cl.SecretNamespace == "" {
+			cl.SecretNamespace = r.namespace
+		}
+		secret, err := r.client.CoreV1().Secrets(cl.SecretNamespace).Get(r.ctx, cl.SecretName, metav1.GetOptions{})
+		if err != nil {
+			klog.Errorf("get secret of cluster %s failed: %v", cl.ClusterId, err)
+			continue
+		}
+		cl.Key = string(secret.Data[secretKeyName])
+		// keep the unchanged cluster, which is compared by pointer in caches
+		if old, ok := r.clusters[cl.ClusterId]; ok && reflect.DeepEqual(old, cl) {
+			cl = old
+		}
+		clusters[cl.ClusterId] = cl
+	}
+	r.clusters = clusters
+	r.loadtime = time.Now()
+	klog.V(2).Infof("cluster registry loaded, %d clusters", len(clusters))
+	return nil
+}
@@ -0,0 +1,58 @@
+package controlrpc
+
+import (
+	"fmt"
+	"strconv"
+
+	alcubv1beta1 "github.com/yylt/csi-alcub/pkg/api/v1beta1"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// storageclass parameters of alcub cache
+	cacheModeParam     = "cacheMode"
+	cacheSizeParam     = "cacheSize"
+	cachePriorityParam = "cachePriority"
+
+	minCachePriority = 1
+	maxCachePriority = 10
+)
+
+// parseCachePolicy return nil if no cache parameter defined, so alcub
+// default is used. mode is writeback when only size or priority defined
+func parseCachePolicy(params map[string]string) (*alcubv1beta1.CachePolicy, error) {
+	var (
+		mode     = params[cacheModeParam]
+		size     = params[cacheSizeParam]
+		priority = params[cachePriorityParam]
+		policy   = &alcubv1beta1.CachePolicy{}
+	)
+	if mode == "" && size == "" && priority == "" {
+		return nil, nil
+	}
+	switch mode {
+	case "":
+		policy.Mode = alcubv1beta1.CacheModeWriteBack
+	case alcubv1beta1.CacheModeWriteBack, alcubv1beta1.CacheModeWriteThrough:
+		policy.Mode = mode
+	default:
+		return nil, fmt.Errorf("invalid %s: %s, support %s and %s", cacheModeParam, mode,
+			alcubv1beta1.CacheModeWriteBack, alcubv1beta1.CacheModeWriteThrough)
+	}
+	if size != "" {
+		q, err := resource.ParseQuantity(size)
+		if err != nil || q.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid %s: %s", cacheSizeParam, size)
+		}
+		policy.Size = q.Value()
+	}
+	if priority != "" {
+		v, err := strconv.Atoi(priority)
+		if err != nil || v < minCachePriority || v > maxCachePriority {
+			return nil, fmt.Errorf("invalid %s: %s, should be in [%d, %d]", cachePriorityParam, priority, minCachePriority, maxCachePriority)
+		}
+		policy.Priority = int32(v)
+	}
+	return policy, nil
+}
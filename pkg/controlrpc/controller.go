@@ -1,16 +1,23 @@
 package controlrpc
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
 	alcubv1beta1 "github.com/yylt/csi-alcub/pkg/api/v1beta1"
+	"github.com/yylt/csi-alcub/pkg/cluster"
 	"github.com/yylt/csi-alcub/pkg/manager"
 	rbd2 "github.com/yylt/csi-alcub/pkg/rbd"
 	"github.com/yylt/csi-alcub/pkg/store"
-	"github.com/yylt/csi-alcub/utils"
+	mtypes "github.com/yylt/csi-alcub/types"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pborman/uuid"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 	klog "k8s.io/klog/v2"
 )
 
@@ -18,23 +25,75 @@ var _ csi.ControllerServer = &Controller{}
 
 var (
 	scParam = "scname"
+	// storageclass parameter, the cluster in registry, default cluster is used when empty
+	clusterIdParam = "clusterID"
+
+	// storageclass parameters which override alcub flags
+	alcubPoolParam            = "alcubPool"
+	alcubApiUrlParam          = "alcubApiUrl"
+	alcubSecretNameParam      = "alcubSecretName"
+	alcubSecretNamespaceParam = "alcubSecretNamespace"
+
+	// added by provisioner when extra-create-metadata enabled
+	pvcNameParam      = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceParam = "csi.storage.k8s.io/pvc/namespace"
+	pvNameParam       = "csi.storage.k8s.io/pv/name"
+
+	// storageclass parameters of image deletion
+	deletePolicyParam   = "deletePolicy"
+	trashDefermentParam = "trashDeferment"
+	defaultDeferment    = 24 * time.Hour
+
+	// pvc annotations which override storageclass parameters
+	deletePolicyAnnotation   = "csi.alcub/delete-policy"
+	trashDefermentAnnotation = "csi.alcub/trash-deferment"
+
+	// key of rbd image metadata
+	MetaVolumeId     = "csi.alcub/volume-id"
+	MetaPvName       = "csi.alcub/pv-name"
+	MetaPvcName      = "csi.alcub/pvc-name"
+	MetaPvcNamespace = "csi.alcub/pvc-namespace"
+	// set when image retained after volume deleted
+	MetaRetained = "csi.alcub/retained"
+	// settings of volume which used by recover
+	MetaClusterId      = "csi.alcub/cluster-id"
+	MetaAlcub          = "csi.alcub/alcub"
+	MetaCache          = "csi.alcub/cache"
+	MetaDeletePolicy   = "csi.alcub/delete-policy"
+	MetaTrashDeferment = "csi.alcub/trash-deferment"
 )
 
+// options of volume which parsed from storageclass parameters
+type volumeOptions struct {
+	image          string
+	deletePolicy   string
+	trashDeferment time.Duration
+	cache          *alcubv1beta1.CachePolicy
+}
+
 type Controller struct {
 	store store.Alcuber
 
 	alcubControl *manager.AlcubCon
 	//Node resource store
-	rbd  *rbd2.Rbd
-	node *Node
-	caps []*csi.ControllerServiceCapability
+	rbd    *rbd2.Rbd
+	node   *Node
+	orphan *OrphanQueue
+	trash  *TrashPurger
+	caps   []*csi.ControllerServiceCapability
+
+	kubecli kubernetes.Interface
+	nodeID  string
 
-	alcubDynConf store.DynConf
-	nodeID       string
+	// encoded in volume id, legacy uuid is used when empty
+	clusterID string
+	// nil if registry not enabled, only the default cluster is used
+	registry *cluster.Registry
 }
 
-func NewController(nodeid string, store store.Alcuber, alcubControl *manager.AlcubCon, rbd *rbd2.Rbd) *Controller {
+func NewController(nodeid string, kubecli kubernetes.Interface, store store.Alcuber, alcubControl *manager.AlcubCon, rbd *rbd2.Rbd) *Controller {
 	return &Controller{
+		kubecli:      kubecli,
 		rbd:          rbd,
 		nodeID:       nodeid,
 		store:        store,
@@ -47,6 +106,25 @@ func NewController(nodeid string, store store.Alcuber, alcubControl *manager.Alc
 	}
 }
 
+func (c *Controller) SetupClusterId(id string) {
+	c.clusterID = id
+}
+
+func (c *Controller) SetupRegistry(registry *cluster.Registry) {
+	c.registry = registry
+}
+
+func (c *Controller) SetupOrphan(queue *OrphanQueue) {
+	if queue == nil {
+		panic("orphan queue is nil")
+	}
+	c.orphan = queue
+}
+
+func (c *Controller) SetupTrash(purger *TrashPurger) {
+	c.trash = purger
+}
+
 func (c *Controller) SetupNode(nodemanager *Node) {
 	if nodemanager == nil {
 		panic("node manager is nil")
@@ -100,75 +178,201 @@ func (c *Controller) StartNode(nodename string, rmblack bool) error {
 	return c.notidyAlcub(nodename, node, false)
 }
 
+// the image will be deleted by finalizer after volume detached
 func (c *Controller) deleteVolume(alcub *alcubv1beta1.CsiAlcub) error {
-	err := c.rbd.DeleteImage(alcub.Spec.RbdSc, alcub.Spec.Image)
+	return c.alcubControl.Delete(alcub.Name)
+}
+
+// DeleteImage called by alcub finalizer
+func (c *Controller) DeleteImage(alcub *alcubv1beta1.CsiAlcub) error {
+	rbd, err := c.rbd.Cluster(alcub.Spec.ClusterId)
 	if err != nil {
 		klog.Errorf("delete image failed:%v", err)
 		return err
 	}
-	return c.alcubControl.Delete(alcub.Name)
+	switch alcub.Spec.DeletePolicy {
+	case alcubv1beta1.DeletePolicyTrash:
+		err = c.trashImage(rbd, alcub)
+	case alcubv1beta1.DeletePolicyRetain:
+		klog.Infof("retain image %s/%s of %s", alcub.Spec.Pool, alcub.Spec.Image, alcub.Name)
+		err = rbd.SetImageMeta(alcub.Spec.RbdSc, alcub.Spec.Image, map[string]string{
+			MetaRetained: time.Now().UTC().Format(time.RFC3339),
+		})
+	default:
+		err = rbd.DeleteImage(alcub.Spec.RbdSc, alcub.Spec.Image)
+	}
+	if err != nil {
+		klog.Errorf("delete image failed:%v", err)
+		return err
+	}
+	return nil
 }
 
-func (c *Controller) notidyAlcub(nodename string, zone *manager.Nodeinfo, fail bool) error {
+// the image is recorded before moved into trash, so only the
+// driver's trash entries are purged
+func (c *Controller) trashImage(rbd *rbd2.Rbd, alcub *alcubv1beta1.CsiAlcub) error {
 	var (
-		buferr  = utils.GetBuf()
-		success bool
+		scname    = alcub.Spec.RbdSc
+		image     = alcub.Spec.Image
+		deferment = alcub.Spec.TrashDeferment.Duration
 	)
-	defer utils.PutBuf(buferr)
-
-	c.alcubDynConf.Nodename = nodename
-
-	actionfn := func(AlucbUrl string) error {
-		c.alcubDynConf.AlucbUrl = []byte(AlucbUrl)
-		if fail {
-			return c.store.FailNode(&c.alcubDynConf, nodename)
-		} else {
-			if strings.Index(AlucbUrl, nodename) < 0 {
-				klog.Infof("skip alcubUrl:%v, because dev stop must be in host:%v", AlucbUrl, nodename)
-				return nil
+	pool, id, err := rbd.ImageId(scname, image)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		// moved into trash already
+		return nil
+	}
+	if c.trash != nil {
+		err = c.trash.Add(alcub.Spec.ClusterId, scname, pool, image, id, time.Now().Add(deferment))
+		if err != nil {
+			return err
+		}
+	}
+	return rbd.TrashImage(scname, image, deferment)
+}
+
+// notify alcub of the clusters which csialcub belongs to, the alcub urls
+// fetched by node are recorded in status, which are different by cluster
+func (c *Controller) notidyAlcub(nodename string, zone *manager.Nodeinfo, fail bool) error {
+	var alcubs []*alcubv1beta1.CsiAlcub
+	err := c.alcubControl.ForEach(func(a *alcubv1beta1.CsiAlcub) {
+		if a.Spec.Pool == "" || a.Spec.Image == "" {
+			klog.Infof("skip %v, pool or image not found", a.Name)
+			return
+		}
+		alcubs = append(alcubs, a.DeepCopy())
+	})
+	if err != nil {
+		klog.Errorf("notify store alcub fail: %v", err)
+		return fmt.Errorf("notify alcub server failed!")
+	}
+	if fail {
+		return c.failNode(nodename, zone, alcubs)
+	}
+
+	for _, a := range alcubs {
+		conf, urls, err := c.alcubConf(a, nodename, zone.Zones)
+		if err != nil {
+			klog.Errorf("stop pool(%v) image(%v) failed: %v", a.Spec.Pool, a.Spec.Image, err)
+			continue
+		}
+		// dev stop must be in the host
+		for _, u := range urls {
+			if strings.Contains(u, nodename) {
+				conf.AlucbUrl = []byte(u)
+				break
 			}
-			return c.alcubControl.ForEach(func(a *alcubv1beta1.CsiAlcub) {
-				if a.Spec.Pool == "" || a.Spec.Image == "" {
-					klog.Infof("skip %v, pool or image not found", a.Name)
-					return
-				}
-				err := c.store.DevStop(&c.alcubDynConf, a.Spec.Pool, a.Spec.Image)
-				if err != nil {
-					klog.Errorf("stop pool(%v) image(%v) failed: %v", a.Spec.Pool, a.Spec.Image, err)
-					return
-				}
-				klog.V(2).Infof("stop pool(%v) image(%v) success", a.Spec.Pool, a.Spec.Image)
-			})
 		}
+		if len(conf.AlucbUrl) == 0 {
+			klog.Infof("skip dev stop of %v, because not found alcub url in host:%v", a.Name, nodename)
+			continue
+		}
+		err = c.store.DevStop(conf, a.Spec.Pool, a.Spec.Image)
+		if mtypes.AlcubReasonOf(err) == mtypes.AlcubNotFound {
+			klog.V(2).Infof("skip stop pool(%v) image(%v), device not found", a.Spec.Pool, a.Spec.Image)
+			continue
+		}
+		if err != nil {
+			klog.Errorf("stop pool(%v) image(%v) failed: %v", a.Spec.Pool, a.Spec.Image, err)
+			continue
+		}
+		klog.V(2).Infof("stop pool(%v) image(%v) success", a.Spec.Pool, a.Spec.Image)
 	}
-	for _, v := range zone.Zones {
-		if v == "" {
+	klog.Infof("notify store alcub dev-stop success")
+	return nil
+}
+
+// failNode notify every cluster which has volume on the node once,
+// and the default cluster is always notified
+func (c *Controller) failNode(nodename string, zone *manager.Nodeinfo, alcubs []*alcubv1beta1.CsiAlcub) error {
+	var (
+		reterr   error
+		notified = map[string]bool{}
+		targets  []*alcubv1beta1.CsiAlcub
+	)
+	for _, a := range alcubs {
+		if a.Status.Node == nodename {
+			targets = append(targets, a)
+		}
+	}
+	targets = append(targets, &alcubv1beta1.CsiAlcub{})
+	for _, a := range targets {
+		key := alcubKey(a)
+		if notified[key] {
+			continue
+		}
+		conf, urls, err := c.alcubConf(a, nodename, zone.Zones)
+		if err != nil {
+			klog.Errorf("notify store alcub fail: %v", err)
+			reterr = fmt.Errorf("notify alcub server failed!")
 			continue
 		}
-		err := actionfn(v)
+		notified[key] = true
+		// store client fail over to the other zones
+		conf.AlucbUrl = []byte(urls[0])
+		conf.SecondaryUrls = urls[1:]
+		err = c.store.FailNode(conf, nodename)
 		if err != nil {
-			buferr.WriteString(err.Error())
+			klog.Errorf("notify store alcub fail: %v", err)
+			reterr = fmt.Errorf("notify alcub server failed!")
 			continue
 		}
-		success = true
-		break
+		klog.Infof("notify store alcub of cluster %q fail-node success", a.Spec.ClusterId)
 	}
-	if buferr.Len() != 0 {
-		klog.Errorf("notify store alcub fail: %v", buferr.Bytes())
+	return reterr
+}
+
+// alcubConf return dynamic configure of the cluster which csialcub belongs to,
+// and the alcub urls in status, the zones of node are used for the default
+// cluster when status is empty
+func (c *Controller) alcubConf(a *alcubv1beta1.CsiAlcub, nodename string, zones []string) (*store.DynConf, []string, error) {
+	var (
+		urls []string
+		conf = &store.DynConf{
+			Nodename: nodename,
+		}
+	)
+	if id := a.Spec.ClusterId; id != "" {
+		if c.registry == nil {
+			return nil, nil, fmt.Errorf("cluster %s not supported, cluster registry not enabled", id)
+		}
+		cl, err := c.registry.Get(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		conf.Cluster = cl
 	}
-	if fail {
-		klog.Infof("notify store alcub fail-node success")
-	} else {
-		klog.Infof("notify store alcub dev-stop success")
+	if s := a.Spec.Alcub; s != nil {
+		conf.Conf = store.NewAlcubConf(s.Pool, s.ApiUrl, s.SecretNamespace, s.SecretName)
 	}
+	all := a.Status.AllNodes
+	if len(all) == 0 && a.Spec.ClusterId == "" {
+		all = zones
+	}
+	for _, v := range all {
+		if v != "" {
+			urls = append(urls, v)
+		}
+	}
+	if len(urls) == 0 {
+		return nil, nil, fmt.Errorf("not found alcub url of cluster %q on node %s", a.Spec.ClusterId, nodename)
+	}
+	return conf, urls, nil
+}
 
-	if !success {
-		return fmt.Errorf("notify alcub server failed!")
+// alcubKey return the cluster and alcub settings of csialcub
+func alcubKey(a *alcubv1beta1.CsiAlcub) string {
+	if s := a.Spec.Alcub; s != nil {
+		return fmt.Sprintf("%s/%s/%s/%s/%s", a.Spec.ClusterId, s.Pool, s.ApiUrl, s.SecretNamespace, s.SecretName)
 	}
-	return nil
+	return a.Spec.ClusterId
 }
 
-func (c *Controller) createVolume(params map[string]string, name, uuid string, bytesize int64) (*alcubv1beta1.CsiAlcubSpec, error) {
+// name is the csialcub name
+func (c *Controller) createVolume(params map[string]string, opts *volumeOptions, name string, bytesize int64) (*alcubv1beta1.CsiAlcubSpec, error) {
+	var image = opts.image
 
 	if params == nil {
 		return nil, fmt.Errorf("params is nil")
@@ -177,23 +381,214 @@ func (c *Controller) createVolume(params map[string]string, name, uuid string, b
 	if !ok {
 		return nil, fmt.Errorf("not found %s in params", scParam)
 	}
-	volume, err := c.rbd.CreateImage(v, name, bytesize)
+	clusterid, err := c.volumeCluster(params[clusterIdParam])
+	if err != nil {
+		return nil, err
+	}
+	settings, err := alcubSettings(params)
+	if err != nil {
+		return nil, err
+	}
+	rbd, err := c.rbd.Cluster(clusterid)
+	if err != nil {
+		return nil, err
+	}
+	volume, err := rbd.CreateImage(v, image, bytesize)
 	if err != nil {
 		return nil, err
 	}
 	defer func() {
 		if err != nil {
-			//TODO should delete image forever if delete failed
-			c.rbd.DeleteImage(v, name)
+			delerr := rbd.DeleteImage(v, image)
+			if delerr == nil {
+				return
+			}
+			klog.Errorf("delete image %s failed: %v", image, delerr)
+			if c.orphan != nil {
+				delerr = c.orphan.Add(clusterid, v, volume.Pool, image, delerr)
+				if delerr != nil {
+					klog.Errorf("add image %s into orphan queue failed: %v", image, delerr)
+				}
+			}
 		}
 	}()
 	spec := &alcubv1beta1.CsiAlcubSpec{
-		Pool:     volume.Pool,
-		Image:    volume.Image,
-		Capacity: bytesize,
-		Uuid:     uuid,
-		RbdSc:    v,
+		Pool:         volume.Pool,
+		Image:        volume.Image,
+		Capacity:     bytesize,
+		Uuid:         c.newVolumeId(clusterid, volume),
+		RbdSc:        v,
+		ClusterId:    clusterid,
+		Alcub:        settings,
+		PvName:       params[pvNameParam],
+		PvcName:      params[pvcNameParam],
+		PvcNamespace: params[pvcNamespaceParam],
+		DeletePolicy: opts.deletePolicy,
+		Cache:        opts.cache,
+		TrashDeferment: metav1.Duration{
+			Duration: opts.trashDeferment,
+		},
 	}
+	c.setImageMeta(spec)
 	err = c.alcubControl.Create(name, spec)
 	return spec, err
 }
+
+// the annotations of pvc override the storageclass parameters
+func parseVolumeOptions(params, annotations map[string]string, reqname string) (*volumeOptions, error) {
+	var (
+		policy    = params[deletePolicyParam]
+		deferment = params[trashDefermentParam]
+	)
+	image, err := imageName(params, reqname)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := annotations[deletePolicyAnnotation]; ok {
+		policy = v
+	}
+	if v, ok := annotations[trashDefermentAnnotation]; ok {
+		deferment = v
+	}
+	opts, err := parseDeletePolicy(policy, deferment, alcubv1beta1.DeletePolicyDelete)
+	if err != nil {
+		return nil, err
+	}
+	opts.image = image
+	opts.cache, err = parseCachePolicy(params)
+	if err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// the default policy is used when policy is empty
+func parseDeletePolicy(policy, deferment, defpolicy string) (*volumeOptions, error) {
+	var (
+		opts = &volumeOptions{}
+		err  error
+	)
+	if policy == "" {
+		policy = defpolicy
+	}
+	switch policy {
+	case alcubv1beta1.DeletePolicyDelete, alcubv1beta1.DeletePolicyRetain:
+		opts.deletePolicy = policy
+	case alcubv1beta1.DeletePolicyTrash:
+		opts.deletePolicy = policy
+		opts.trashDeferment = defaultDeferment
+		if deferment != "" {
+			opts.trashDeferment, err = time.ParseDuration(deferment)
+			if err != nil || opts.trashDeferment < 0 {
+				return nil, fmt.Errorf("invalid %s: %s", trashDefermentParam, deferment)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid %s: %s", deletePolicyParam, policy)
+	}
+	return opts, nil
+}
+
+// fetch pvc annotations, return nil if pvc info not in params
+func (c *Controller) pvcAnnotations(params map[string]string) (map[string]string, error) {
+	name, namespace := params[pvcNameParam], params[pvcNamespaceParam]
+	if name == "" || namespace == "" || c.kubecli == nil {
+		return nil, nil
+	}
+	pvc, err := c.kubecli.CoreV1().PersistentVolumeClaims(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return pvc.Annotations, nil
+}
+
+// alcubSettings return nil if no alcub parameter defined,
+// only the reference of secret is saved
+func alcubSettings(params map[string]string) (*alcubv1beta1.AlcubSettings, error) {
+	s := &alcubv1beta1.AlcubSettings{
+		Pool:            params[alcubPoolParam],
+		ApiUrl:          params[alcubApiUrlParam],
+		SecretName:      params[alcubSecretNameParam],
+		SecretNamespace: params[alcubSecretNamespaceParam],
+	}
+	if (s.SecretName == "") != (s.SecretNamespace == "") {
+		return nil, fmt.Errorf("%s and %s must be defined together", alcubSecretNameParam, alcubSecretNamespaceParam)
+	}
+	if *s == (alcubv1beta1.AlcubSettings{}) {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// volumeCluster return the cluster id which recorded in csialcub,
+// empty means the default cluster
+func (c *Controller) volumeCluster(id string) (string, error) {
+	if id == "" || id == c.clusterID {
+		return "", nil
+	}
+	if c.registry == nil {
+		return "", fmt.Errorf("cluster %s not supported, cluster registry not enabled", id)
+	}
+	_, err := c.registry.Get(id)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// return self-describing volume id if cluster id defined and not too long,
+// the default cluster id is used when clusterid is empty
+func (c *Controller) newVolumeId(clusterid string, volume *rbd2.Volume) string {
+	if clusterid == "" {
+		clusterid = c.clusterID
+	}
+	if clusterid != "" {
+		volid := (&mtypes.VolumeId{
+			ClusterId: clusterid,
+			Pool:      volume.Pool,
+			Image:     volume.Image,
+		}).String()
+		if len(volid) <= mtypes.MaxVolumeIdLen {
+			return volid
+		}
+		klog.Warningf("volume id %s is too long, use uuid instead", volid)
+	}
+	return uuid.NewUUID().String()
+}
+
+// write volume info into image metadata, which used to find pvc by image
+// and recover the settings of csialcub
+func (c *Controller) setImageMeta(spec *alcubv1beta1.CsiAlcubSpec) {
+	meta := map[string]string{
+		MetaVolumeId:     spec.Uuid,
+		MetaDeletePolicy: spec.DeletePolicy,
+	}
+	if spec.DeletePolicy == alcubv1beta1.DeletePolicyTrash {
+		meta[MetaTrashDeferment] = spec.TrashDeferment.Duration.String()
+	}
+	if spec.ClusterId != "" {
+		meta[MetaClusterId] = spec.ClusterId
+	}
+	if spec.Alcub != nil {
+		b, _ := json.Marshal(spec.Alcub)
+		meta[MetaAlcub] = string(b)
+	}
+	if spec.Cache != nil {
+		b, _ := json.Marshal(spec.Cache)
+		meta[MetaCache] = string(b)
+	}
+	if spec.PvName != "" {
+		meta[MetaPvName] = spec.PvName
+	}
+	if spec.PvcName != "" {
+		meta[MetaPvcName] = spec.PvcName
+		meta[MetaPvcNamespace] = spec.PvcNamespace
+	}
+	rbd, err := c.rbd.Cluster(spec.ClusterId)
+	if err == nil {
+		err = rbd.SetImageMeta(spec.RbdSc, spec.Image, meta)
+	}
+	if err != nil {
+		klog.Warningf("set image %s metadata failed: %v", spec.Image, err)
+	}
+}
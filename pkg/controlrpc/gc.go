@@ -0,0 +1,247 @@
+package controlrpc
+
+import (
+	"context"
+	"path"
+	"strings"
+	"time"
+
+	alcubv1beta1 "github.com/yylt/csi-alcub/pkg/api/v1beta1"
+	"github.com/yylt/csi-alcub/pkg/manager"
+	rbd2 "github.com/yylt/csi-alcub/pkg/rbd"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+	klog "k8s.io/klog/v2"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	orphanImages = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "csi_alcub_orphan_images",
+		Help: "Number of rbd images which have no csialcub",
+	})
+	orphanAlcubs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "csi_alcub_orphan_alcubs",
+		Help: "Number of csialcubs which have no persistent volume",
+	})
+	danglingPvs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "csi_alcub_dangling_pvs",
+		Help: "Number of persistent volumes which have no csialcub",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(orphanImages, orphanAlcubs, danglingPvs)
+}
+
+type GCConf struct {
+	// the driver name in pv and storageclass
+	Drivername string
+	// id of the default cluster, images of registry clusters are not checked
+	ClusterId string
+	// optional, only image with prefix will be checked
+	ImagePrefix string
+	Interval    time.Duration
+	// csialcub created in grace time will not be treated as orphan
+	Grace time.Duration
+	// delete orphan image and csialcub, only report if false
+	Delete bool
+}
+
+// GC cross-check rbd images, csialcub and persistent volumes
+// 1. rbd image without csialcub, which is created by driver according to metadata
+// 2. csialcub without pv
+// 3. pv without csialcub, which only be reported
+type GC struct {
+	ctx          context.Context
+	client       client.Client
+	alcubControl *manager.AlcubCon
+	rbd          *rbd2.Rbd
+	orphan       *OrphanQueue
+	recorder     record.EventRecorder
+	conf         GCConf
+
+	// orphan images found in last scan, key: pool/image
+	// image should be orphan in two scans before deleted
+	suspects sets.String
+}
+
+func NewGC(mgr ctrl.Manager, alcubControl *manager.AlcubCon, rbd *rbd2.Rbd, orphan *OrphanQueue, conf GCConf) (*GC, error) {
+	gc := &GC{
+		ctx:          context.Background(),
+		client:       mgr.GetClient(),
+		alcubControl: alcubControl,
+		rbd:          rbd,
+		orphan:       orphan,
+		recorder:     mgr.GetEventRecorderFor("csi-alcub"),
+		conf:         conf,
+		suspects:     sets.NewString(),
+	}
+	return gc, mgr.Add(gc)
+}
+
+// Start implement manager.Runnable
+func (gc *GC) Start(ctx context.Context) error {
+	go wait.Until(gc.scan, gc.conf.Interval, ctx.Done())
+	return nil
+}
+
+// NeedLeaderElection only leader do gc
+func (gc *GC) NeedLeaderElection() bool {
+	return true
+}
+
+func (gc *GC) scan() {
+	var (
+		pvs      corev1.PersistentVolumeList
+		scs      storagev1.StorageClassList
+		alcubs   []alcubv1beta1.CsiAlcub
+		uuids    = sets.NewString()
+		images   = sets.NewString()
+		handles  = sets.NewString()
+		rbdscs   = sets.NewString()
+		suspects = sets.NewString()
+
+		nimage, nalcub, npv int
+	)
+	err := gc.alcubControl.ForEach(func(a *alcubv1beta1.CsiAlcub) {
+		alcubs = append(alcubs, *a)
+		uuids.Insert(a.Spec.Uuid)
+		images.Insert(path.Join(a.Spec.Pool, a.Spec.Image))
+		if a.Spec.RbdSc != "" && a.Spec.ClusterId == "" {
+			rbdscs.Insert(a.Spec.RbdSc)
+		}
+	})
+	if err != nil {
+		klog.Errorf("gc list csialcub failed: %v", err)
+		return
+	}
+	err = gc.client.List(gc.ctx, &pvs)
+	if err != nil {
+		klog.Errorf("gc list pv failed: %v", err)
+		return
+	}
+	err = gc.client.List(gc.ctx, &scs)
+	if err != nil {
+		klog.Errorf("gc list storageclass failed: %v", err)
+		return
+	}
+
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != gc.conf.Drivername {
+			continue
+		}
+		handles.Insert(pv.Spec.CSI.VolumeHandle)
+		if uuids.Has(pv.Spec.CSI.VolumeHandle) {
+			continue
+		}
+		npv++
+		klog.Warningf("gc found pv %s without csialcub, volumeHandle: %s", pv.Name, pv.Spec.CSI.VolumeHandle)
+		gc.recorder.Eventf(pv, corev1.EventTypeWarning, "MissingCsiAlcub", "not found csialcub by volumeHandle %s", pv.Spec.CSI.VolumeHandle)
+	}
+
+	for i := range alcubs {
+		a := &alcubs[i]
+		if handles.Has(a.Spec.Uuid) || a.DeletionTimestamp != nil {
+			continue
+		}
+		if time.Since(a.CreationTimestamp.Time) < gc.conf.Grace {
+			continue
+		}
+		nalcub++
+		klog.Warningf("gc found csialcub %s without pv", a.Name)
+		gc.recorder.Eventf(a, corev1.EventTypeWarning, "MissingPV", "not found pv by volumeHandle %s", a.Spec.Uuid)
+		if gc.conf.Delete {
+			err = gc.alcubControl.Delete(a.Name)
+			if err != nil {
+				klog.Errorf("gc delete csialcub %s failed: %v", a.Name, err)
+			}
+		}
+	}
+
+	for i := range scs.Items {
+		sc := &scs.Items[i]
+		if sc.Provisioner != gc.conf.Drivername {
+			continue
+		}
+		if id := sc.Parameters[clusterIdParam]; id != "" && id != gc.conf.ClusterId {
+			continue
+		}
+		if v, ok := sc.Parameters[scParam]; ok && v != "" {
+			rbdscs.Insert(v)
+		}
+	}
+	for _, scname := range rbdscs.List() {
+		pool, list, err := gc.rbd.ListImages(scname)
+		if err != nil {
+			klog.Errorf("gc list images by storageclass %s failed: %v", scname, err)
+			continue
+		}
+		for _, image := range list {
+			key := path.Join(pool, image)
+			if !strings.HasPrefix(image, gc.conf.ImagePrefix) || images.Has(key) || suspects.Has(key) {
+				continue
+			}
+			if !gc.driverImage(scname, image, handles) {
+				continue
+			}
+			suspects.Insert(key)
+			if !gc.suspects.Has(key) {
+				continue
+			}
+			nimage++
+			klog.Warningf("gc found image %s without csialcub", key)
+			gc.eventOnStorageClass(scname, "OrphanImage", "image %s has no csialcub", key)
+			if gc.conf.Delete && gc.orphan != nil {
+				err = gc.orphan.Add("", scname, pool, image, nil)
+				if err != nil {
+					klog.Errorf("gc add image %s into orphan queue failed: %v", key, err)
+				}
+			}
+		}
+	}
+	gc.suspects = suspects
+
+	orphanImages.Set(float64(nimage))
+	orphanAlcubs.Set(float64(nalcub))
+	danglingPvs.Set(float64(npv))
+	klog.V(2).Infof("gc done, orphan images: %d, orphan csialcubs: %d, pv without csialcub: %d", nimage, nalcub, npv)
+}
+
+// driverImage return true if image is created or imported by driver, and
+// no pv use it. image without metadata is not owned by driver
+func (gc *GC) driverImage(scname, image string, handles sets.String) bool {
+	meta, err := gc.rbd.GetImageMeta(scname, image)
+	if err != nil {
+		klog.Errorf("gc get metadata of image %s failed: %v", image, err)
+		return false
+	}
+	volid, ok := meta[MetaVolumeId]
+	if !ok {
+		return false
+	}
+	// retained by delete policy after volume deleted
+	if _, ok = meta[MetaRetained]; ok {
+		return false
+	}
+	// csialcub lost, but pv still exist, it's recreated when published
+	return !handles.Has(volid)
+}
+
+func (gc *GC) eventOnStorageClass(scname, reason, msgfmt string, args ...interface{}) {
+	var sc storagev1.StorageClass
+	err := gc.client.Get(gc.ctx, client.ObjectKey{Name: scname}, &sc)
+	if err != nil {
+		klog.Errorf("get storageclass %s failed: %v", scname, err)
+		return
+	}
+	gc.recorder.Eventf(&sc, corev1.EventTypeWarning, reason, msgfmt, args...)
+}
@@ -0,0 +1,71 @@
+package controlrpc
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strings"
+)
+
+const (
+	// storageclass parameter, example: k8s-${pvc.namespace}-${pvc.name}-${pv.name}
+	imageNameTemplateParam = "imageNameTemplate"
+
+	tplPvcName      = "${pvc.name}"
+	tplPvcNamespace = "${pvc.namespace}"
+	tplPvName       = "${pv.name}"
+
+	maxImageNameLen = 128
+	hashSuffixLen   = 8
+)
+
+// imageName return rbd image name by template in params,
+// the request name is used when template not defined.
+// template must include ${pv.name}, so image name is unique.
+func imageName(params map[string]string, reqname string) (string, error) {
+	tpl := params[imageNameTemplateParam]
+	if tpl == "" {
+		return reqname, nil
+	}
+	if !strings.Contains(tpl, tplPvName) {
+		return "", fmt.Errorf("%s must include %s", imageNameTemplateParam, tplPvName)
+	}
+	if strings.Contains(tpl, tplPvcName) || strings.Contains(tpl, tplPvcNamespace) {
+		if params[pvcNameParam] == "" || params[pvcNamespaceParam] == "" {
+			return "", fmt.Errorf("pvc name or namespace not found, provisioner should enable extra-create-metadata")
+		}
+	}
+	pvname := params[pvNameParam]
+	if pvname == "" {
+		pvname = reqname
+	}
+	name := strings.NewReplacer(
+		tplPvcName, escapeImageName(params[pvcNameParam]),
+		tplPvcNamespace, escapeImageName(params[pvcNamespaceParam]),
+		tplPvName, escapeImageName(pvname),
+	).Replace(tpl)
+	if strings.Contains(name, "${") {
+		return "", fmt.Errorf("unknown variable in %s: %s", imageNameTemplateParam, tpl)
+	}
+	if escapeImageName(name) != name {
+		return "", fmt.Errorf("invalid character in %s: %s", imageNameTemplateParam, tpl)
+	}
+	if len(name) > maxImageNameLen {
+		// keep unique by hash of full name
+		sum := fmt.Sprintf("%x", sha1.Sum([]byte(name)))
+		name = name[:maxImageNameLen-hashSuffixLen-1] + "-" + sum[:hashSuffixLen]
+	}
+	return name, nil
+}
+
+// only [a-zA-Z0-9._-] is allowed, others replaced by '-'
+func escapeImageName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '.' || r == '_' || r == '-':
+			return r
+		}
+		return '-'
+	}, s)
+}
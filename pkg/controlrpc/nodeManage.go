@@ -5,6 +5,8 @@ import (
 	"context"
 	"fmt"
 
+	mtypes "github.com/yylt/csi-alcub/types"
+
 	corev1 "k8s.io/api/core/v1"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/client-go/util/retry"
@@ -22,7 +24,7 @@ var (
 		Effect: corev1.TaintEffectNoSchedule,
 	}
 	//hosthaKv   = map[string]string{"hostha-maintain": "true"}
-	csiBlackKv = map[string]string{"csi-alcub.io/maintain": "true"}
+	csiBlackKv = map[string]string{mtypes.NodeMaintainAnnotation: "true"}
 
 	tempNodeKey = "%N"
 )
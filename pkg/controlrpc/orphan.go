@@ -0,0 +1,216 @@
+package controlrpc
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	rbd2 "github.com/yylt/csi-alcub/pkg/rbd"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	klog "k8s.io/klog/v2"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	orphanBaseDelay = 30 * time.Second
+	orphanMaxDelay  = time.Hour
+	// report by event when failed too many times
+	orphanReportAttempts = 5
+)
+
+// orphan image which should be deleted
+type orphanItem struct {
+	// empty means the default cluster
+	ClusterId string    `json:"clusterID,omitempty"`
+	RbdSc     string    `json:"rbdStorageClass"`
+	Pool      string    `json:"pool,omitempty"`
+	Image     string    `json:"image"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"lastError,omitempty"`
+	NextRetry time.Time `json:"nextRetry"`
+}
+
+// OrphanQueue save orphan images in configmap, and retry delete
+// with exponential backoff until success, so it survives restart.
+// key: cluster.pool.image, value: orphanItem json
+type OrphanQueue struct {
+	ctx       context.Context
+	client    kubernetes.Interface
+	rbd       *rbd2.Rbd
+	recorder  record.EventRecorder
+	namespace string
+	name      string
+	interval  time.Duration
+
+	mu sync.Mutex
+}
+
+func NewOrphanQueue(mgr ctrl.Manager, client kubernetes.Interface, rbd *rbd2.Rbd, namespace, name string, interval time.Duration) (*OrphanQueue, error) {
+	if namespace == "" || name == "" {
+		return nil, fmt.Errorf("orphan configmap namespace and name must not be empty")
+	}
+	q := &OrphanQueue{
+		ctx:       context.Background(),
+		client:    client,
+		rbd:       rbd,
+		recorder:  mgr.GetEventRecorderFor("csi-alcub"),
+		namespace: namespace,
+		name:      name,
+		interval:  interval,
+	}
+	return q, mgr.Add(q)
+}
+
+// Add image into queue, the first retry is after base delay
+func (q *OrphanQueue) Add(clusterid, scname, pool, image string, reason error) error {
+	key := itemKey(clusterid, pool, image)
+	item := &orphanItem{
+		ClusterId: clusterid,
+		RbdSc:     scname,
+		Pool:      pool,
+		Image:     image,
+		NextRetry: time.Now().Add(orphanBaseDelay),
+	}
+	if reason != nil {
+		item.LastError = reason.Error()
+	}
+	klog.Warningf("image %s add into orphan queue: %v", key, reason)
+	return q.update(func(data map[string]string) {
+		if _, ok := data[key]; ok {
+			return
+		}
+		b, _ := json.Marshal(item)
+		data[key] = string(b)
+	})
+}
+
+// Start implement manager.Runnable
+func (q *OrphanQueue) Start(ctx context.Context) error {
+	go wait.Until(q.process, q.interval, ctx.Done())
+	return nil
+}
+
+// NeedLeaderElection only leader delete orphan images
+func (q *OrphanQueue) NeedLeaderElection() bool {
+	return true
+}
+
+func (q *OrphanQueue) process() {
+	cm, err := q.client.CoreV1().ConfigMaps(q.namespace).Get(q.ctx, q.name, metav1.GetOptions{})
+	if err != nil {
+		if !apierrs.IsNotFound(err) {
+			klog.Errorf("get orphan configmap failed: %v", err)
+		}
+		return
+	}
+	now := time.Now()
+	for image, v := range cm.Data {
+		var item orphanItem
+		err = json.Unmarshal([]byte(v), &item)
+		if err != nil {
+			klog.Errorf("invalid orphan item %s: %v", image, err)
+			continue
+		}
+		if now.Before(item.NextRetry) {
+			continue
+		}
+		rbd, err := q.rbd.Cluster(item.ClusterId)
+		if err == nil {
+			err = rbd.DeleteImage(item.RbdSc, item.Image)
+		}
+		if err == nil {
+			klog.Infof("orphan image %s deleted after %d attempts", image, item.Attempts+1)
+			err = q.update(func(data map[string]string) {
+				delete(data, image)
+			})
+			if err != nil {
+				klog.Errorf("remove orphan item %s failed: %v", image, err)
+			}
+			continue
+		}
+		item.Attempts++
+		item.LastError = err.Error()
+		item.NextRetry = now.Add(orphanBackoff(item.Attempts))
+		klog.Errorf("delete orphan image %s failed %d times: %v", image, item.Attempts, err)
+		if item.Attempts >= orphanReportAttempts {
+			q.recorder.Eventf(cm, corev1.EventTypeWarning, "OrphanDeleteFailed", "delete orphan image %s failed %d times: %v", image, item.Attempts, err)
+		}
+		b, _ := json.Marshal(&item)
+		err = q.update(func(data map[string]string) {
+			if _, ok := data[image]; ok {
+				data[image] = string(b)
+			}
+		})
+		if err != nil {
+			klog.Errorf("update orphan item %s failed: %v", image, err)
+		}
+	}
+}
+
+func (q *OrphanQueue) update(fn func(data map[string]string)) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return updateConfigMap(q.ctx, q.client, q.namespace, q.name, fn)
+}
+
+// itemKey return configmap key of image, the key is hashed
+// when it include characters which configmap not allowed
+func itemKey(clusterid, pool, image string) string {
+	key := strings.TrimPrefix(strings.Join([]string{clusterid, pool, image}, "."), ".")
+	if len(validation.IsConfigMapKey(key)) == 0 {
+		return key
+	}
+	return fmt.Sprintf("%x", sha1.Sum([]byte(key)))
+}
+
+// update configmap, create it if not exist
+func updateConfigMap(ctx context.Context, client kubernetes.Interface, namespace, name string, fn func(data map[string]string)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cms := client.CoreV1().ConfigMaps(namespace)
+		cm, err := cms.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			if !apierrs.IsNotFound(err) {
+				return err
+			}
+			cm = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: namespace,
+				},
+				Data: map[string]string{},
+			}
+			fn(cm.Data)
+			_, err = cms.Create(ctx, cm, metav1.CreateOptions{})
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		fn(cm.Data)
+		_, err = cms.Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func orphanBackoff(attempts int) time.Duration {
+	delay := orphanBaseDelay
+	for i := 0; i < attempts; i++ {
+		delay *= 2
+		if delay >= orphanMaxDelay {
+			return orphanMaxDelay
+		}
+	}
+	return delay
+}
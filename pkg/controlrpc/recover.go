@@ -0,0 +1,374 @@
+package controlrpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	alcubv1beta1 "github.com/yylt/csi-alcub/pkg/api/v1beta1"
+	"github.com/yylt/csi-alcub/pkg/manager"
+	rbd2 "github.com/yylt/csi-alcub/pkg/rbd"
+	mtypes "github.com/yylt/csi-alcub/types"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	klog "k8s.io/klog/v2"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// action of recover item
+const (
+	RecoverCreate = "create"
+	RecoverExist  = "exist"
+	RecoverSkip   = "skip"
+)
+
+// where the image found
+const (
+	sourceVolumeId   = "volume-id"
+	sourceAttributes = "volume-attributes"
+	sourceImageMeta  = "image-meta"
+	sourcePvName     = "pv-name"
+)
+
+type RecoverItem struct {
+	Action string
+	Name   string
+	Source string
+	Reason string
+	Spec   alcubv1beta1.CsiAlcubSpec
+	Node   string
+}
+
+// Recover rebuild csialcub from pv, volumeattachment and rbd image metadata
+type Recover struct {
+	client     client.Client
+	rbd        *rbd2.Rbd
+	drivername string
+	clusterID  string
+
+	// key: cluster/rbd storageclass, value: map of volume id and image
+	metaIndex map[string]map[string]string
+	// key: cluster/rbd storageclass, value: images
+	images map[string]sets.String
+}
+
+func NewRecover(cli client.Client, rbd *rbd2.Rbd, drivername, clusterID string) *Recover {
+	return &Recover{
+		client:     cli,
+		rbd:        rbd,
+		drivername: drivername,
+		clusterID:  clusterID,
+	}
+}
+
+// Plan return the csialcub which should be created, nothing changed
+func (r *Recover) Plan(ctx context.Context) ([]RecoverItem, error) {
+	var (
+		pvs    corev1.PersistentVolumeList
+		vas    storagev1.VolumeAttachmentList
+		alcubs alcubv1beta1.CsiAlcubList
+		items  []RecoverItem
+		uuids  = sets.NewString()
+		// key: pv name, value: node name
+		attached = map[string]string{}
+	)
+	r.metaIndex = map[string]map[string]string{}
+	r.images = map[string]sets.String{}
+
+	err := r.client.List(ctx, &alcubs)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range alcubs.Items {
+		uuids.Insert(a.Spec.Uuid)
+	}
+	err = r.client.List(ctx, &vas)
+	if err != nil {
+		return nil, err
+	}
+	for _, va := range vas.Items {
+		if va.Spec.Attacher != r.drivername || va.Spec.Source.PersistentVolumeName == nil || !va.Status.Attached {
+			continue
+		}
+		attached[*va.Spec.Source.PersistentVolumeName] = va.Spec.NodeName
+	}
+	err = r.client.List(ctx, &pvs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != r.drivername {
+			continue
+		}
+		var item RecoverItem
+		if uuids.Has(pv.Spec.CSI.VolumeHandle) {
+			item.Action = RecoverExist
+			item.Name = pv.Name
+			item.Spec.Uuid = pv.Spec.CSI.VolumeHandle
+		} else {
+			item = r.planPv(ctx, pv)
+		}
+		item.Node = attached[pv.Name]
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (r *Recover) planPv(ctx context.Context, pv *corev1.PersistentVolume) RecoverItem {
+	var (
+		handle = pv.Spec.CSI.VolumeHandle
+		attrs  = pv.Spec.CSI.VolumeAttributes
+		item   = RecoverItem{
+			Action: RecoverSkip,
+			Name:   pv.Name,
+		}
+	)
+	item.Spec.Uuid = handle
+	item.Spec.PvName = pv.Name
+	if pv.Spec.ClaimRef != nil {
+		item.Spec.PvcName = pv.Spec.ClaimRef.Name
+		item.Spec.PvcNamespace = pv.Spec.ClaimRef.Namespace
+	}
+	if q, ok := pv.Spec.Capacity[corev1.ResourceStorage]; ok {
+		item.Spec.Capacity = q.Value()
+	}
+	scname := attrs[scParam]
+	if scname == "" && pv.Spec.StorageClassName != "" {
+		var sc storagev1.StorageClass
+		err := r.client.Get(ctx, client.ObjectKey{Name: pv.Spec.StorageClassName}, &sc)
+		if err == nil {
+			scname = sc.Parameters[scParam]
+		}
+	}
+	if scname == "" {
+		item.Reason = "rbd storageclass not found"
+		return item
+	}
+	item.Spec.RbdSc = scname
+
+	var (
+		defpolicy = alcubv1beta1.DeletePolicyDelete
+		clusterid = attrs[clusterIdParam]
+	)
+	vid, viderr := mtypes.ParseVolumeId(handle)
+	if viderr == nil {
+		clusterid = vid.ClusterId
+	}
+	if clusterid == r.clusterID {
+		clusterid = ""
+	}
+	rbd, err := r.rbd.Cluster(clusterid)
+	if err != nil {
+		item.Reason = fmt.Sprintf("volume belongs to unknown cluster %s: %v", clusterid, err)
+		return item
+	}
+	item.Spec.ClusterId = clusterid
+	if viderr == nil {
+		item.Spec.Pool, item.Spec.Image, item.Source = vid.Pool, vid.Image, sourceVolumeId
+	} else if image := attrs[staticImageAttr]; image != "" {
+		item.Spec.Image, item.Source = image, sourceAttributes
+		item.Name = staticName(handle)
+		defpolicy = alcubv1beta1.DeletePolicyRetain
+	} else {
+		item.Spec.Image, item.Source = r.findImage(rbd, clusterid, scname, handle, pv.Name)
+	}
+	if item.Spec.Image == "" {
+		item.Reason = "image not found"
+		return item
+	}
+	volume, _, err := rbd.ImageInfo(scname, item.Spec.Image)
+	if err != nil {
+		item.Reason = fmt.Sprintf("get image info failed: %v", err)
+		return item
+	}
+	if item.Spec.Pool != "" && item.Spec.Pool != volume.Pool {
+		item.Reason = fmt.Sprintf("pool %s is not same as storageclass pool %s", item.Spec.Pool, volume.Pool)
+		return item
+	}
+	item.Spec.Pool = volume.Pool
+
+	meta, err := rbd.GetImageMeta(scname, item.Spec.Image)
+	if err != nil {
+		item.Reason = fmt.Sprintf("get image metadata failed: %v", err)
+		return item
+	}
+	if v, ok := meta[MetaVolumeId]; ok && v != handle {
+		item.Reason = fmt.Sprintf("image is used by volume %s", v)
+		return item
+	}
+	if v, ok := meta[MetaClusterId]; ok && v != clusterid {
+		item.Reason = fmt.Sprintf("image belongs to cluster %s", v)
+		return item
+	}
+	err = recoverSettings(&item.Spec, attrs, meta, defpolicy)
+	if err != nil {
+		item.Reason = err.Error()
+		return item
+	}
+	item.Action = RecoverCreate
+	return item
+}
+
+// RestoreSettings restore the settings of image which restored from trash,
+// the delete policy is delete if not recorded in image metadata
+func RestoreSettings(spec *alcubv1beta1.CsiAlcubSpec, meta map[string]string) error {
+	return recoverSettings(spec, nil, meta, alcubv1beta1.DeletePolicyDelete)
+}
+
+// recoverSettings restore the settings from image metadata which written
+// when volume created, volume attributes are used for old images
+func recoverSettings(spec *alcubv1beta1.CsiAlcubSpec, attrs, meta map[string]string, defpolicy string) error {
+	var (
+		policy    = attrs[deletePolicyParam]
+		deferment = attrs[trashDefermentParam]
+	)
+	if v, ok := meta[MetaDeletePolicy]; ok {
+		policy, deferment = v, meta[MetaTrashDeferment]
+	}
+	opts, err := parseDeletePolicy(policy, deferment, defpolicy)
+	if err != nil {
+		return err
+	}
+	spec.DeletePolicy = opts.deletePolicy
+	spec.TrashDeferment.Duration = opts.trashDeferment
+
+	if v, ok := meta[MetaAlcub]; ok {
+		spec.Alcub = &alcubv1beta1.AlcubSettings{}
+		err = json.Unmarshal([]byte(v), spec.Alcub)
+		if err != nil {
+			return fmt.Errorf("invalid metadata %s: %v", MetaAlcub, err)
+		}
+	} else {
+		spec.Alcub, err = alcubSettings(attrs)
+		if err != nil {
+			return err
+		}
+	}
+	if v, ok := meta[MetaCache]; ok {
+		spec.Cache = &alcubv1beta1.CachePolicy{}
+		err = json.Unmarshal([]byte(v), spec.Cache)
+		if err != nil {
+			return fmt.Errorf("invalid metadata %s: %v", MetaCache, err)
+		}
+	} else {
+		spec.Cache, err = parseCachePolicy(attrs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// find image by metadata volume id, or image name is same as pv name
+func (r *Recover) findImage(rbd *rbd2.Rbd, clusterid, scname, handle, pvname string) (string, string) {
+	key := clusterid + "/" + scname
+	index, ok := r.metaIndex[key]
+	if !ok {
+		index = map[string]string{}
+		images := sets.NewString()
+		_, list, err := rbd.ListImages(scname)
+		if err != nil {
+			klog.Errorf("list images by storageclass %s failed: %v", scname, err)
+		}
+		for _, image := range list {
+			images.Insert(image)
+			meta, err := rbd.GetImageMeta(scname, image)
+			if err != nil {
+				continue
+			}
+			if volid := meta[MetaVolumeId]; volid != "" {
+				index[volid] = image
+			}
+		}
+		r.metaIndex[key] = index
+		r.images[key] = images
+	}
+	if image, ok := index[handle]; ok {
+		return image, sourceImageMeta
+	}
+	if r.images[key].Has(pvname) {
+		return pvname, sourcePvName
+	}
+	return "", ""
+}
+
+// Apply create csialcub which action is create
+func (r *Recover) Apply(ctx context.Context, items []RecoverItem) error {
+	var failed int
+	for i := range items {
+		item := &items[i]
+		if item.Action != RecoverCreate {
+			continue
+		}
+		obj := manager.NewCsiAlcub(item.Name, &item.Spec)
+		obj.Status.Node = item.Node
+		err := r.client.Create(ctx, obj)
+		if err != nil && !apierrs.IsAlreadyExists(err) {
+			klog.Errorf("recover csialcub %s failed: %v", item.Name, err)
+			failed++
+			continue
+		}
+		klog.Infof("recover csialcub %s success, image: %s/%s", item.Name, item.Spec.Pool, item.Spec.Image)
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d csialcub recover failed", failed)
+	}
+	return nil
+}
+
+// PrintRecover print items as diff table
+func PrintRecover(w io.Writer, items []RecoverItem) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tNAME\tVOLUMEHANDLE\tIMAGE\tSOURCE\tNODE\tREASON")
+	for _, item := range items {
+		var image string
+		if item.Spec.Image != "" {
+			image = item.Spec.Pool + "/" + item.Spec.Image
+		}
+		prefix := " "
+		if item.Action == RecoverCreate {
+			prefix = "+"
+		}
+		fmt.Fprintf(tw, "%s %s\t%s\t%s\t%s\t%s\t%s\t%s\n", prefix, item.Action, item.Name, item.Spec.Uuid, image, item.Source, item.Node, item.Reason)
+	}
+	return tw.Flush()
+}
+
+// RecoverRunner recover csialcub once when controller started
+type RecoverRunner struct {
+	rc *Recover
+}
+
+func NewRecoverRunner(mgr ctrl.Manager, rbd *rbd2.Rbd, drivername, clusterID string) error {
+	return mgr.Add(&RecoverRunner{
+		rc: NewRecover(mgr.GetClient(), rbd, drivername, clusterID),
+	})
+}
+
+// Start implement manager.Runnable
+func (rr *RecoverRunner) Start(ctx context.Context) error {
+	go func() {
+		items, err := rr.rc.Plan(ctx)
+		if err != nil {
+			klog.Errorf("plan recover failed: %v", err)
+			return
+		}
+		err = rr.rc.Apply(ctx, items)
+		if err != nil {
+			klog.Errorf("apply recover failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// NeedLeaderElection only leader recover
+func (rr *RecoverRunner) NeedLeaderElection() bool {
+	return true
+}
@@ -2,8 +2,9 @@ package controlrpc
 
 import (
 	"context"
+	"errors"
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/pborman/uuid"
+	mtypes "github.com/yylt/csi-alcub/types"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	klog "k8s.io/klog/v2"
@@ -85,11 +86,20 @@ func (c *Controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 		}
 	}
 
-	volumeID := uuid.NewUUID().String()
-	_, err := c.createVolume(req.GetParameters(), req.GetName(), volumeID, capacity)
+	annotations, err := c.pvcAnnotations(req.GetParameters())
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to create volume %v, %v", volumeID, err)
+		return nil, status.Errorf(codes.Internal, "failed to get pvc: %v", err)
 	}
+	opts, err := parseVolumeOptions(req.GetParameters(), annotations, req.GetName())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	spec, err := c.createVolume(req.GetParameters(), opts, req.GetName(), capacity)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create volume %v, %v", req.GetName(), err)
+	}
+	volumeID := spec.Uuid
 
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
@@ -111,7 +121,16 @@ func (c *Controller) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequ
 	)
 	alcub := c.alcubControl.GetByUuid(volid)
 	if alcub == nil {
-		klog.V(2).Infof("volume %v had deleted!", volid)
+		vid, err := mtypes.ParseVolumeId(volid)
+		if err != nil {
+			klog.V(2).Infof("volume %v had deleted!", volid)
+			return &csi.DeleteVolumeResponse{}, nil
+		}
+		// csialcub lost, the image is found by self-describing volume id
+		err = c.deleteLostVolume(volid, vid)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to delete volume %v: %v", volid, err)
+		}
 		return &csi.DeleteVolumeResponse{}, nil
 	}
 	err := c.deleteVolume(alcub)
@@ -122,7 +141,35 @@ func (c *Controller) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequ
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
-func (c *Controller) ControllerPublishVolume(context.Context, *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+// csialcub of pre-provisioned pv is created here when first used,
+// and also for self-describing volume id when csialcub is lost
+func (c *Controller) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	var (
+		volid = req.GetVolumeId()
+	)
+	if len(volid) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	alcub := c.alcubControl.GetByUuid(volid)
+	if alcub != nil {
+		return &csi.ControllerPublishVolumeResponse{}, nil
+	}
+	attrs, err := c.volumeAttrs(volid, req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if _, ok := attrs[staticImageAttr]; !ok {
+		return nil, status.Errorf(codes.NotFound, "not found resource by uuid %v", volid)
+	}
+	// image is only in volume id of dynamic volume
+	_, static := req.GetVolumeContext()[staticImageAttr]
+	_, err = c.importVolume(volid, attrs, !static)
+	if errors.Is(err, errImageInUse) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to import volume %v: %v", volid, err)
+	}
 	return &csi.ControllerPublishVolumeResponse{}, nil
 }
 func (c *Controller) ControllerUnpublishVolume(context.Context, *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
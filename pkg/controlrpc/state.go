@@ -0,0 +1,232 @@
+package controlrpc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	alcubv1beta1 "github.com/yylt/csi-alcub/pkg/api/v1beta1"
+	"github.com/yylt/csi-alcub/pkg/manager"
+	rbd2 "github.com/yylt/csi-alcub/pkg/rbd"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	klog "k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	StateVersion = "csialcub.es.io/state-v1"
+	StateKind    = "CsiAlcubState"
+)
+
+// StateBundle include csialcubs and pvs which used for migration
+// between kubernetes clusters which share one ceph cluster
+type StateBundle struct {
+	ApiVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	ExportTime metav1.Time   `json:"exportTime"`
+	Volumes    []StateVolume `json:"volumes"`
+}
+
+type StateVolume struct {
+	Name string                    `json:"name"`
+	Spec alcubv1beta1.CsiAlcubSpec `json:"spec"`
+	// nil when pv not found
+	Pv *StatePv `json:"pv,omitempty"`
+}
+
+type StatePv struct {
+	Name             string                               `json:"name"`
+	StorageClassName string                               `json:"storageClassName,omitempty"`
+	Capacity         resource.Quantity                    `json:"capacity"`
+	AccessModes      []corev1.PersistentVolumeAccessMode  `json:"accessModes,omitempty"`
+	ReclaimPolicy    corev1.PersistentVolumeReclaimPolicy `json:"reclaimPolicy,omitempty"`
+	VolumeMode       *corev1.PersistentVolumeMode         `json:"volumeMode,omitempty"`
+	FsType           string                               `json:"fsType,omitempty"`
+	VolumeAttributes map[string]string                    `json:"volumeAttributes,omitempty"`
+	MountOptions     []string                             `json:"mountOptions,omitempty"`
+	ClaimRef         *StateClaim                          `json:"claimRef,omitempty"`
+}
+
+type StateClaim struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+// State export and import csialcub
+type State struct {
+	client     client.Client
+	rbd        *rbd2.Rbd
+	drivername string
+}
+
+func NewState(cli client.Client, rbd *rbd2.Rbd, drivername string) *State {
+	return &State{
+		client:     cli,
+		rbd:        rbd,
+		drivername: drivername,
+	}
+}
+
+func (s *State) Export(ctx context.Context) (*StateBundle, error) {
+	var (
+		alcubs alcubv1beta1.CsiAlcubList
+		pvs    corev1.PersistentVolumeList
+		// key: volume handle
+		pvmap = map[string]*corev1.PersistentVolume{}
+	)
+	err := s.client.List(ctx, &alcubs)
+	if err != nil {
+		return nil, err
+	}
+	err = s.client.List(ctx, &pvs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != s.drivername {
+			continue
+		}
+		pvmap[pv.Spec.CSI.VolumeHandle] = pv
+	}
+	bundle := &StateBundle{
+		ApiVersion: StateVersion,
+		Kind:       StateKind,
+		ExportTime: metav1.NewTime(time.Now()),
+	}
+	for _, a := range alcubs.Items {
+		if a.DeletionTimestamp != nil {
+			continue
+		}
+		vol := StateVolume{
+			Name: a.Name,
+			Spec: a.Spec,
+		}
+		if pv, ok := pvmap[a.Spec.Uuid]; ok {
+			vol.Pv = exportPv(pv)
+		} else {
+			klog.Warningf("not found pv of csialcub %s", a.Name)
+		}
+		bundle.Volumes = append(bundle.Volumes, vol)
+	}
+	return bundle, nil
+}
+
+func exportPv(pv *corev1.PersistentVolume) *StatePv {
+	spv := &StatePv{
+		Name:             pv.Name,
+		StorageClassName: pv.Spec.StorageClassName,
+		Capacity:         pv.Spec.Capacity[corev1.ResourceStorage],
+		AccessModes:      pv.Spec.AccessModes,
+		ReclaimPolicy:    pv.Spec.PersistentVolumeReclaimPolicy,
+		VolumeMode:       pv.Spec.VolumeMode,
+		FsType:           pv.Spec.CSI.FSType,
+		VolumeAttributes: pv.Spec.CSI.VolumeAttributes,
+		MountOptions:     pv.Spec.MountOptions,
+	}
+	if pv.Spec.ClaimRef != nil {
+		spv.ClaimRef = &StateClaim{
+			Name:      pv.Spec.ClaimRef.Name,
+			Namespace: pv.Spec.ClaimRef.Namespace,
+		}
+	}
+	return spv
+}
+
+// Import create csialcub and static pv after image checked,
+// the pv is pre-bound to the claim, so pvc with same name will bind it.
+// the image is still owned by source cluster, so both csialcub and pv are
+// retained, which should be changed after source cluster cleaned up.
+// nothing created when dryrun.
+func (s *State) Import(ctx context.Context, bundle *StateBundle, dryrun bool) error {
+	var failed int
+	if bundle.ApiVersion != StateVersion || bundle.Kind != StateKind {
+		return fmt.Errorf("unsupported bundle %s/%s, expect %s/%s", bundle.ApiVersion, bundle.Kind, StateVersion, StateKind)
+	}
+	for i := range bundle.Volumes {
+		vol := &bundle.Volumes[i]
+		err := s.importVolume(ctx, vol, dryrun)
+		if err != nil {
+			klog.Errorf("import csialcub %s failed: %v", vol.Name, err)
+			failed++
+			continue
+		}
+		if dryrun {
+			klog.Infof("import csialcub %s check success", vol.Name)
+		} else {
+			klog.Infof("import csialcub %s success", vol.Name)
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d volumes import failed", failed)
+	}
+	return nil
+}
+
+func (s *State) importVolume(ctx context.Context, vol *StateVolume, dryrun bool) error {
+	rbd, err := s.rbd.Cluster(vol.Spec.ClusterId)
+	if err != nil {
+		return err
+	}
+	volume, _, err := rbd.ImageInfo(vol.Spec.RbdSc, vol.Spec.Image)
+	if err != nil {
+		return fmt.Errorf("check image %s/%s failed: %v", vol.Spec.Pool, vol.Spec.Image, err)
+	}
+	if volume.Pool != vol.Spec.Pool {
+		return fmt.Errorf("pool %s is not same as storageclass pool %s", vol.Spec.Pool, volume.Pool)
+	}
+	if dryrun {
+		return nil
+	}
+	spec := vol.Spec.DeepCopy()
+	if spec.DeletePolicy != alcubv1beta1.DeletePolicyRetain {
+		klog.Warningf("delete policy of csialcub %s is changed from %s to %s", vol.Name, spec.DeletePolicy, alcubv1beta1.DeletePolicyRetain)
+		spec.DeletePolicy = alcubv1beta1.DeletePolicyRetain
+	}
+	err = s.client.Create(ctx, manager.NewCsiAlcub(vol.Name, spec))
+	if err != nil && !apierrs.IsAlreadyExists(err) {
+		return err
+	}
+	if vol.Pv == nil {
+		return nil
+	}
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: vol.Pv.Name,
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			Capacity: corev1.ResourceList{
+				corev1.ResourceStorage: vol.Pv.Capacity,
+			},
+			AccessModes:                   vol.Pv.AccessModes,
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+			StorageClassName:              vol.Pv.StorageClassName,
+			VolumeMode:                    vol.Pv.VolumeMode,
+			MountOptions:                  vol.Pv.MountOptions,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:           s.drivername,
+					VolumeHandle:     vol.Spec.Uuid,
+					FSType:           vol.Pv.FsType,
+					VolumeAttributes: vol.Pv.VolumeAttributes,
+				},
+			},
+		},
+	}
+	if vol.Pv.ClaimRef != nil {
+		pv.Spec.ClaimRef = &corev1.ObjectReference{
+			Kind:      "PersistentVolumeClaim",
+			Name:      vol.Pv.ClaimRef.Name,
+			Namespace: vol.Pv.ClaimRef.Namespace,
+		}
+	}
+	err = s.client.Create(ctx, pv)
+	if err != nil && !apierrs.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
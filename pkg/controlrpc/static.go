@@ -0,0 +1,240 @@
+package controlrpc
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"strings"
+
+	alcubv1beta1 "github.com/yylt/csi-alcub/pkg/api/v1beta1"
+	"github.com/yylt/csi-alcub/pkg/manager"
+	rbd2 "github.com/yylt/csi-alcub/pkg/rbd"
+	mtypes "github.com/yylt/csi-alcub/types"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	// volumeAttributes of pre-provisioned pv, and scname is required too
+	staticPoolAttr  = "pool"
+	staticImageAttr = "image"
+
+	staticNamePrefix = "static-"
+)
+
+var errImageInUse = errors.New("image is used by other csialcub")
+
+// importVolume create csialcub for the existed image which defined in
+// volumeAttributes of pre-provisioned pv, the volume id is used as uuid.
+// the image is retained by default when csialcub deleted, but dynamic
+// volume whose csialcub lost use the policy of storageclass and pvc.
+func (c *Controller) importVolume(volid string, attrs map[string]string, dynamic bool) (*alcubv1beta1.CsiAlcub, error) {
+	scname, image := attrs[scParam], attrs[staticImageAttr]
+	if scname == "" || image == "" {
+		return nil, fmt.Errorf("%s and %s must be defined in volumeAttributes", scParam, staticImageAttr)
+	}
+	clusterid, err := c.volumeCluster(attrs[clusterIdParam])
+	if err != nil {
+		return nil, err
+	}
+	rbd, err := c.rbd.Cluster(clusterid)
+	if err != nil {
+		return nil, err
+	}
+	volume, size, err := rbd.ImageInfo(scname, image)
+	if err != nil {
+		return nil, err
+	}
+	if pool := attrs[staticPoolAttr]; pool != "" && pool != volume.Pool {
+		return nil, fmt.Errorf("pool %s is not same as the pool %s of storageclass %s", pool, volume.Pool, scname)
+	}
+	var (
+		policy    = attrs[deletePolicyParam]
+		deferment = attrs[trashDefermentParam]
+		defpolicy = alcubv1beta1.DeletePolicyRetain
+	)
+	if dynamic {
+		// volume context of dynamic volume is the storageclass parameters
+		defpolicy = alcubv1beta1.DeletePolicyDelete
+		annotations, err := c.pvcAnnotations(attrs)
+		if err != nil {
+			klog.Warningf("get pvc of volume %s failed, use storageclass policy: %v", volid, err)
+		}
+		if v, ok := annotations[deletePolicyAnnotation]; ok {
+			policy = v
+		}
+		if v, ok := annotations[trashDefermentAnnotation]; ok {
+			deferment = v
+		}
+	}
+	opts, err := parseDeletePolicy(policy, deferment, defpolicy)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := parseCachePolicy(attrs)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := alcubSettings(attrs)
+	if err != nil {
+		return nil, err
+	}
+	owner, err := c.imageOwner(clusterid, volume)
+	if err != nil {
+		return nil, err
+	}
+	if owner != nil && owner.Spec.Uuid != volid {
+		return nil, fmt.Errorf("%w: %s/%s is used by %s", errImageInUse, volume.Pool, volume.Image, owner.Name)
+	}
+
+	name := staticName(volid)
+	spec := &alcubv1beta1.CsiAlcubSpec{
+		Uuid:         volid,
+		Capacity:     size,
+		RbdSc:        scname,
+		Pool:         volume.Pool,
+		Image:        volume.Image,
+		DeletePolicy: opts.deletePolicy,
+		ClusterId:    clusterid,
+		Alcub:        settings,
+		Cache:        cache,
+		PvName:       attrs[pvNameParam],
+		PvcName:      attrs[pvcNameParam],
+		PvcNamespace: attrs[pvcNamespaceParam],
+	}
+	spec.TrashDeferment.Duration = opts.trashDeferment
+	err = c.alcubControl.Create(name, spec)
+	if err != nil {
+		if _, ok := err.(mtypes.AlreadyExist); !ok {
+			return nil, err
+		}
+	}
+	klog.Infof("import image %s/%s as csialcub %s, volume id: %s", volume.Pool, volume.Image, name, volid)
+	c.setImageMeta(spec)
+	alcub, err := c.alcubControl.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("get csialcub %s after created failed: %v", name, err)
+	}
+	if alcub.Spec.Uuid != volid {
+		return nil, fmt.Errorf("csialcub %s already exist with different uuid %s", name, alcub.Spec.Uuid)
+	}
+	return alcub, nil
+}
+
+// imageOwner return the csialcub which use the image, nil if not found
+func (c *Controller) imageOwner(clusterid string, volume *rbd2.Volume) (*alcubv1beta1.CsiAlcub, error) {
+	var owner *alcubv1beta1.CsiAlcub
+	err := c.alcubControl.ForEach(func(a *alcubv1beta1.CsiAlcub) {
+		if a.Spec.ClusterId == clusterid && a.Spec.Pool == volume.Pool && a.Spec.Image == volume.Image {
+			owner = a.DeepCopy()
+		}
+	})
+	return owner, err
+}
+
+// volumeAttrs return volume context with pool and image which parsed from
+// self-describing volume id, legacy volume id is ignored
+func (c *Controller) volumeAttrs(volid string, volctx map[string]string) (map[string]string, error) {
+	attrs := make(map[string]string, len(volctx)+2)
+	for k, v := range volctx {
+		attrs[k] = v
+	}
+	vid, err := mtypes.ParseVolumeId(volid)
+	if err != nil {
+		return attrs, nil
+	}
+	_, err = c.volumeCluster(vid.ClusterId)
+	if err != nil {
+		return nil, fmt.Errorf("volume %s belongs to unknown cluster %s: %v", volid, vid.ClusterId, err)
+	}
+	attrs[clusterIdParam] = vid.ClusterId
+	attrs[staticPoolAttr] = vid.Pool
+	attrs[staticImageAttr] = vid.Image
+	return attrs, nil
+}
+
+// deleteLostVolume delete image of self-describing volume id whose csialcub
+// is lost, the rbd storageclass is found in volume attributes of pv, and the
+// policy recorded in image metadata is used. success if image not found
+func (c *Controller) deleteLostVolume(volid string, vid *mtypes.VolumeId) error {
+	clusterid, err := c.volumeCluster(vid.ClusterId)
+	if err != nil {
+		return err
+	}
+	attrs, err := c.pvAttrs(volid)
+	if err != nil {
+		return err
+	}
+	scname := attrs[scParam]
+	if scname == "" {
+		return fmt.Errorf("%s not found in volume attributes of volume %s", scParam, volid)
+	}
+	rbd, err := c.rbd.Cluster(clusterid)
+	if err != nil {
+		return err
+	}
+	pool, id, err := rbd.ImageId(scname, vid.Image)
+	if err != nil {
+		return err
+	}
+	if pool != vid.Pool {
+		return fmt.Errorf("pool %s is not same as the pool %s of storageclass %s", vid.Pool, pool, scname)
+	}
+	if id == "" {
+		klog.V(2).Infof("image %s/%s of volume %v had deleted!", vid.Pool, vid.Image, volid)
+		return nil
+	}
+	var (
+		policy    = attrs[deletePolicyParam]
+		deferment = attrs[trashDefermentParam]
+	)
+	meta, err := rbd.GetImageMeta(scname, vid.Image)
+	if err != nil {
+		return err
+	}
+	if v, ok := meta[MetaDeletePolicy]; ok {
+		policy, deferment = v, meta[MetaTrashDeferment]
+	}
+	opts, err := parseDeletePolicy(policy, deferment, alcubv1beta1.DeletePolicyDelete)
+	if err != nil {
+		return err
+	}
+	alcub := manager.NewCsiAlcub(staticName(volid), &alcubv1beta1.CsiAlcubSpec{
+		Uuid:         volid,
+		RbdSc:        scname,
+		Pool:         vid.Pool,
+		Image:        vid.Image,
+		ClusterId:    clusterid,
+		DeletePolicy: opts.deletePolicy,
+	})
+	alcub.Spec.TrashDeferment.Duration = opts.trashDeferment
+	klog.Infof("csialcub of volume %s lost, delete image %s/%s by policy %s", volid, vid.Pool, vid.Image, opts.deletePolicy)
+	return c.DeleteImage(alcub)
+}
+
+// pvAttrs return volume attributes of pv by volume handle
+func (c *Controller) pvAttrs(volid string) (map[string]string, error) {
+	pvs, err := c.kubecli.CoreV1().PersistentVolumes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.CSI != nil && pv.Spec.CSI.VolumeHandle == volid {
+			return pv.Spec.CSI.VolumeAttributes, nil
+		}
+	}
+	return nil, fmt.Errorf("not found pv of volume %s", volid)
+}
+
+// csialcub name of pre-provisioned volume, use hash if volume id is invalid name
+func staticName(volid string) string {
+	name := staticNamePrefix + strings.ToLower(volid)
+	if len(validation.IsDNS1123Subdomain(name)) == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s%x", staticNamePrefix, sha1.Sum([]byte(volid)))
+}
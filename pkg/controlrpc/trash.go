@@ -0,0 +1,134 @@
+package controlrpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	rbd2 "github.com/yylt/csi-alcub/pkg/rbd"
+
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	klog "k8s.io/klog/v2"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// image moved into trash by driver
+type trashItem struct {
+	// empty means the default cluster
+	ClusterId string    `json:"clusterID,omitempty"`
+	RbdSc     string    `json:"rbdStorageClass"`
+	Pool      string    `json:"pool"`
+	Image     string    `json:"image"`
+	Id        string    `json:"id"`
+	Expires   time.Time `json:"expires"`
+}
+
+// TrashPurger record images which moved into trash by driver in configmap,
+// and remove them by id after expired, so the trash entries created by
+// others are never touched.
+// key: cluster.pool.image, value: trashItem json
+type TrashPurger struct {
+	ctx       context.Context
+	client    kubernetes.Interface
+	rbd       *rbd2.Rbd
+	namespace string
+	name      string
+	// purge is disabled when 0
+	interval time.Duration
+
+	mu sync.Mutex
+}
+
+func NewTrashPurger(mgr ctrl.Manager, client kubernetes.Interface, rbd *rbd2.Rbd, namespace, name string, interval time.Duration) (*TrashPurger, error) {
+	if namespace == "" || name == "" {
+		return nil, fmt.Errorf("trash configmap namespace and name must not be empty")
+	}
+	p := &TrashPurger{
+		ctx:       context.Background(),
+		client:    client,
+		rbd:       rbd,
+		namespace: namespace,
+		name:      name,
+		interval:  interval,
+	}
+	return p, mgr.Add(p)
+}
+
+// Add record the image before it moved into trash
+func (p *TrashPurger) Add(clusterid, scname, pool, image, id string, expires time.Time) error {
+	key := itemKey(clusterid, pool, image)
+	b, _ := json.Marshal(&trashItem{
+		ClusterId: clusterid,
+		RbdSc:     scname,
+		Pool:      pool,
+		Image:     image,
+		Id:        id,
+		Expires:   expires,
+	})
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return updateConfigMap(p.ctx, p.client, p.namespace, p.name, func(data map[string]string) {
+		data[key] = string(b)
+	})
+}
+
+// Start implement manager.Runnable
+func (p *TrashPurger) Start(ctx context.Context) error {
+	if p.interval > 0 {
+		go wait.Until(p.purge, p.interval, ctx.Done())
+	}
+	return nil
+}
+
+// NeedLeaderElection only leader purge trash
+func (p *TrashPurger) NeedLeaderElection() bool {
+	return true
+}
+
+func (p *TrashPurger) purge() {
+	cm, err := p.client.CoreV1().ConfigMaps(p.namespace).Get(p.ctx, p.name, metav1.GetOptions{})
+	if err != nil {
+		if !apierrs.IsNotFound(err) {
+			klog.Errorf("get trash configmap failed: %v", err)
+		}
+		return
+	}
+	now := time.Now()
+	for key, v := range cm.Data {
+		var item trashItem
+		err = json.Unmarshal([]byte(v), &item)
+		if err != nil {
+			klog.Errorf("invalid trash item %s: %v", key, err)
+			continue
+		}
+		if now.Before(item.Expires) {
+			continue
+		}
+		// nil if restored or removed by others
+		rbd, err := p.rbd.Cluster(item.ClusterId)
+		if err == nil {
+			err = rbd.TrashRemove(item.RbdSc, item.Id)
+		}
+		if err != nil {
+			klog.Errorf("remove image %s(%s) from trash failed: %v", key, item.Id, err)
+			continue
+		}
+		klog.Infof("image %s(%s) purged from trash", key, item.Id)
+		p.mu.Lock()
+		err = updateConfigMap(p.ctx, p.client, p.namespace, p.name, func(data map[string]string) {
+			// the same image may be trashed again
+			if data[key] == v {
+				delete(data, key)
+			}
+		})
+		p.mu.Unlock()
+		if err != nil {
+			klog.Errorf("remove trash item %s failed: %v", key, err)
+		}
+	}
+}
@@ -9,9 +9,11 @@ import (
 	alcubv1beta1 "github.com/yylt/csi-alcub/pkg/api/v1beta1"
 	mtypes "github.com/yylt/csi-alcub/types"
 
+	corev1 "k8s.io/api/core/v1"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
 	klog "k8s.io/klog/v2"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -31,16 +33,25 @@ type Nodeinfo struct {
 }
 
 func (ni *Nodeinfo) DeepCopy() *Nodeinfo {
-	tmpn := &Nodeinfo{}
-	copy(tmpn.StoreIp, ni.StoreIp)
-	copy(tmpn.Zones, ni.Zones)
-	return tmpn
+	return &Nodeinfo{
+		StoreIp: append(net.IP(nil), ni.StoreIp...),
+		Zones:   append([]string(nil), ni.Zones...),
+	}
 }
 
+// delete the backend of alcub, such as rbd image
+// must be idempotent, because it will be called again after failed or restart
+type DeleteFn func(alcub *alcubv1beta1.CsiAlcub) error
+
 type AlcubCon struct {
-	client client.Client
-	reader cache.Cache
-	ctx    context.Context
+	client    client.Client
+	reader    cache.Cache
+	apiReader client.Reader
+	ctx       context.Context
+	recorder  record.EventRecorder
+
+	// only the controller set deleter and handle finalizer
+	deleter DeleteFn
 
 	mu sync.RWMutex
 
@@ -55,12 +66,14 @@ type AlcubCon struct {
 
 func NewAlcubCon(mgr ctrl.Manager) *AlcubCon {
 	alcub := &AlcubCon{
-		client:   mgr.GetClient(),
-		reader:   mgr.GetCache(),
-		ctx:      context.Background(),
-		mu:       sync.RWMutex{},
-		uuidname: make(map[string]string),
-		nodes:    make(map[string]*Nodeinfo),
+		client:    mgr.GetClient(),
+		reader:    mgr.GetCache(),
+		apiReader: mgr.GetAPIReader(),
+		ctx:       context.Background(),
+		recorder:  mgr.GetEventRecorderFor("csi-alcub"),
+		mu:        sync.RWMutex{},
+		uuidname:  make(map[string]string),
+		nodes:     make(map[string]*Nodeinfo),
 	}
 	err := alcub.probe(mgr)
 	if err != nil {
@@ -69,6 +82,13 @@ func NewAlcubCon(mgr ctrl.Manager) *AlcubCon {
 	return alcub
 }
 
+func (al *AlcubCon) SetupDeleter(fn DeleteFn) {
+	if fn == nil {
+		panic("deleter is nil")
+	}
+	al.deleter = fn
+}
+
 func (al *AlcubCon) probe(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&alcubv1beta1.CsiAlcub{}).
@@ -95,18 +115,7 @@ func (al *AlcubCon) Reconcile(ctx context.Context, req reconcile.Request) (recon
 	}
 	if alcub.DeletionTimestamp != nil {
 		klog.Infof("object is deleting: %v", req.String())
-		if al.validBeDelete(&alcub) == nil {
-			alcub.Finalizers = nil
-			retry.RetryOnConflict(retry.DefaultRetry, func() error {
-				err := al.client.Update(al.ctx, &alcub)
-				if err != nil {
-					klog.Errorf("update object(%s) failed:%v", req.String(), err)
-					return err
-				}
-				return nil
-			})
-		}
-		return ctrl.Result{}, nil
+		return al.finalize(&alcub)
 	}
 	err = al.reverseUuid(alcub.Spec.Uuid, alcub.Name)
 	if err != nil {
@@ -134,15 +143,7 @@ func (al *AlcubCon) Create(name string, spec *alcubv1beta1.CsiAlcubSpec) error {
 		}
 	}()
 
-	newobj := alcubv1beta1.CsiAlcub{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:       name,
-			Finalizers: finalizers,
-		},
-		Spec:   *spec,
-		Status: alcubv1beta1.CsiAlcubStatus{},
-	}
-	reterr = al.client.Create(al.ctx, &newobj)
+	reterr = al.client.Create(al.ctx, NewCsiAlcub(name, spec))
 	if reterr != nil {
 		if apierrs.IsAlreadyExists(reterr) {
 			return mtypes.NewAlreadyExistError(fmt.Sprintf("%s is alerady exist!", name))
@@ -152,6 +153,18 @@ func (al *AlcubCon) Create(name string, spec *alcubv1beta1.CsiAlcubSpec) error {
 	return nil
 }
 
+// NewCsiAlcub return object with finalizer
+func NewCsiAlcub(name string, spec *alcubv1beta1.CsiAlcubSpec) *alcubv1beta1.CsiAlcub {
+	return &alcubv1beta1.CsiAlcub{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       name,
+			Finalizers: finalizers,
+		},
+		Spec:   *spec,
+		Status: alcubv1beta1.CsiAlcubStatus{},
+	}
+}
+
 func (al *AlcubCon) Delete(name string) error {
 	var (
 		nsname = types.NamespacedName{
@@ -163,11 +176,22 @@ func (al *AlcubCon) Delete(name string) error {
 
 	err := al.client.Get(al.ctx, nsname, obj)
 	if err != nil {
+		if apierrs.IsNotFound(err) {
+			return nil
+		}
 		return err
 	}
+	if obj.DeletionTimestamp != nil {
+		// finalizer is working
+		return nil
+	}
 
 	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		return al.client.Delete(al.ctx, obj)
+		err := al.client.Delete(al.ctx, obj)
+		if apierrs.IsNotFound(err) {
+			return nil
+		}
+		return err
 	})
 }
 
@@ -198,6 +222,22 @@ func (al *AlcubCon) ForEach(fn func(a *alcubv1beta1.CsiAlcub)) error {
 	return nil
 }
 
+// Get read csialcub from api server, which is not in cache if just created
+func (al *AlcubCon) Get(name string) (*alcubv1beta1.CsiAlcub, error) {
+	var (
+		nsname = types.NamespacedName{
+			Namespace: defaultNs,
+			Name:      name,
+		}
+		obj = &alcubv1beta1.CsiAlcub{}
+	)
+	err := al.apiReader.Get(al.ctx, nsname, obj)
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
 func (al *AlcubCon) GetByName(name string) *alcubv1beta1.CsiAlcub {
 	var (
 		nsname = types.NamespacedName{
@@ -294,7 +334,7 @@ func (al *AlcubCon) reverseNode(stat *alcubv1beta1.CsiAlcubStatus) {
 		return
 	}
 	oldv.StoreIp = ip
-	copy(oldv.Zones, stat.AllNodes)
+	oldv.Zones = append([]string(nil), stat.AllNodes...)
 	al.nodes[stat.Node] = oldv
 }
 
@@ -312,6 +352,113 @@ func (al *AlcubCon) reverseUuid(uuid, name string) error {
 	return nil
 }
 
+// finalize is a state machine, phase is saved in status
+// so it can continue after restart
+// 1. WaitDetach: requeue until status node is empty
+// 2. Deleting: delete rbd image, requeue if failed
+// 3. remove finalizer
+func (al *AlcubCon) finalize(alcub *alcubv1beta1.CsiAlcub) (reconcile.Result, error) {
+	if al.deleter == nil || !hasFinalizer(alcub.Finalizers) {
+		return ctrl.Result{}, nil
+	}
+	if alcub.Status.Phase != alcubv1beta1.PhaseDeleting {
+		err := al.validBeDelete(alcub)
+		if err != nil {
+			if alcub.Status.Phase != alcubv1beta1.PhaseWaitDetach {
+				al.recorder.Eventf(alcub, corev1.EventTypeNormal, alcubv1beta1.PhaseWaitDetach, "wait volume detach from node %s", alcub.Status.Node)
+			}
+			klog.V(2).Infof("csialcub(%s) can not be deleted now: %v", alcub.Name, err)
+			return ctrl.Result{Requeue: true}, al.setPhase(alcub, alcubv1beta1.PhaseWaitDetach)
+		}
+		err = al.setPhase(alcub, alcubv1beta1.PhaseDeleting)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		al.recorder.Event(alcub, corev1.EventTypeNormal, alcubv1beta1.PhaseDeleting, "volume detached, start delete image")
+	}
+
+	err := al.deleter(alcub)
+	if err != nil {
+		klog.Errorf("delete csialcub(%s) backend failed: %v", alcub.Name, err)
+		al.recorder.Eventf(alcub, corev1.EventTypeWarning, "DeleteFailed", "delete image %s/%s failed: %v", alcub.Spec.Pool, alcub.Spec.Image, err)
+		return ctrl.Result{Requeue: true}, nil
+	}
+	al.recorder.Eventf(alcub, corev1.EventTypeNormal, "Deleted", "image %s/%s deleted", alcub.Spec.Pool, alcub.Spec.Image)
+
+	err = al.updateObj(alcub.Name, func(obj *alcubv1beta1.CsiAlcub) {
+		obj.Finalizers = removeFinalizer(obj.Finalizers)
+	})
+	if err != nil {
+		klog.Errorf("remove finalizer on csialcub(%s) failed: %v", alcub.Name, err)
+		return ctrl.Result{}, err
+	}
+	al.releaseUuid(alcub.Spec.Uuid)
+	return ctrl.Result{}, nil
+}
+
+func (al *AlcubCon) setPhase(alcub *alcubv1beta1.CsiAlcub, phase string) error {
+	if alcub.Status.Phase == phase {
+		return nil
+	}
+	err := al.updateObj(alcub.Name, func(obj *alcubv1beta1.CsiAlcub) {
+		obj.Status.Phase = phase
+	})
+	if err != nil {
+		klog.Errorf("update csialcub(%s) phase to %s failed: %v", alcub.Name, phase, err)
+		return err
+	}
+	alcub.Status.Phase = phase
+	return nil
+}
+
+// Progress record message on status and event, empty message clear it
+func (al *AlcubCon) Progress(alcub *alcubv1beta1.CsiAlcub, reason, message string) {
+	if message != "" {
+		al.recorder.Event(alcub, corev1.EventTypeNormal, reason, message)
+	}
+	if alcub.Status.Message == message {
+		return
+	}
+	err := al.updateObj(alcub.Name, func(obj *alcubv1beta1.CsiAlcub) {
+		obj.Status.Message = message
+	})
+	if err != nil {
+		klog.Errorf("update csialcub(%s) message failed: %v", alcub.Name, err)
+		return
+	}
+	alcub.Status.Message = message
+}
+
+// fetch the latest object and update it by fn
+func (al *AlcubCon) updateObj(name string, fn func(obj *alcubv1beta1.CsiAlcub)) error {
+	var (
+		nsname = types.NamespacedName{
+			Namespace: defaultNs,
+			Name:      name,
+		}
+	)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		obj := &alcubv1beta1.CsiAlcub{}
+		err := al.client.Get(al.ctx, nsname, obj)
+		if err != nil {
+			return err
+		}
+		fn(obj)
+		return al.client.Update(al.ctx, obj)
+	})
+}
+
+func removeFinalizer(fs []string) []string {
+	var retfs []string
+	for _, f := range fs {
+		if hasFinalizer([]string{f}) {
+			continue
+		}
+		retfs = append(retfs, f)
+	}
+	return retfs
+}
+
 func (al *AlcubCon) validBeDelete(alcub *alcubv1beta1.CsiAlcub) error {
 	if alcub.Status.Node != "" {
 		return fmt.Errorf("status node is not nil")
@@ -0,0 +1,168 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	alcubv1beta1 "github.com/yylt/csi-alcub/pkg/api/v1beta1"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	klog "k8s.io/klog/v2"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const (
+	ValidatePath = "/validate-csialcub"
+
+	serviceAccountPrefix = "system:serviceaccount:"
+)
+
+var _ admission.Handler = &AlcubValidator{}
+
+// validate CsiAlcub which created or updated by user
+// 1. spec is immutable after created, except delete policy for legal hold
+// 2. uuid and image must be unique
+// 3. status node and finalizer can not be changed by user when attached
+type AlcubValidator struct {
+	client  client.Client
+	decoder *admission.Decoder
+
+	// user which can update status.node and finalizer,
+	// nobody is trusted if empty
+	trusted sets.String
+}
+
+func NewAlcubValidator(mgr ctrl.Manager, trusted []string) *AlcubValidator {
+	v := &AlcubValidator{
+		client:  mgr.GetClient(),
+		trusted: sets.NewString(),
+	}
+	for _, u := range trusted {
+		u = strings.TrimSpace(u)
+		if u != "" {
+			v.trusted.Insert(u)
+		}
+	}
+	mgr.GetWebhookServer().Register(ValidatePath, &webhook.Admission{Handler: v})
+	return v
+}
+
+func (v *AlcubValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+func (v *AlcubValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	var (
+		alcub  alcubv1beta1.CsiAlcub
+		oldobj alcubv1beta1.CsiAlcub
+		err    error
+	)
+	switch req.Operation {
+	case admissionv1.Create:
+		err = v.decoder.Decode(req, &alcub)
+		if err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		err = v.validCreate(ctx, &alcub)
+	case admissionv1.Update:
+		err = v.decoder.Decode(req, &alcub)
+		if err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		err = v.decoder.DecodeRaw(req.OldObject, &oldobj)
+		if err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		err = v.validUpdate(&oldobj, &alcub, req.UserInfo.Username)
+	default:
+		return admission.Allowed("")
+	}
+	if err != nil {
+		klog.Infof("deny %s csialcub(%s) by user %s: %v", req.Operation, req.Name, req.UserInfo.Username, err)
+		return admission.Denied(err.Error())
+	}
+	return admission.Allowed("")
+}
+
+func (v *AlcubValidator) validCreate(ctx context.Context, alcub *alcubv1beta1.CsiAlcub) error {
+	var (
+		lists alcubv1beta1.CsiAlcubList
+	)
+	if alcub.Spec.Uuid == "" {
+		return fmt.Errorf("spec.uuid must not be empty")
+	}
+	err := v.client.List(ctx, &lists)
+	if err != nil {
+		return err
+	}
+	for _, item := range lists.Items {
+		if item.Name == alcub.Name {
+			continue
+		}
+		if item.Spec.Uuid == alcub.Spec.Uuid {
+			return fmt.Errorf("uuid %s is already used by %s", alcub.Spec.Uuid, item.Name)
+		}
+		if alcub.Spec.Image != "" && item.Spec.ClusterId == alcub.Spec.ClusterId &&
+			item.Spec.Pool == alcub.Spec.Pool && item.Spec.Image == alcub.Spec.Image {
+			return fmt.Errorf("image %s/%s is already used by %s", alcub.Spec.Pool, alcub.Spec.Image, item.Name)
+		}
+	}
+	return nil
+}
+
+func (v *AlcubValidator) validUpdate(oldobj, newobj *alcubv1beta1.CsiAlcub, user string) error {
+	oldspec, newspec := oldobj.Spec.DeepCopy(), newobj.Spec.DeepCopy()
+	oldspec.DeletePolicy, newspec.DeletePolicy = "", ""
+	oldspec.TrashDeferment, newspec.TrashDeferment = metav1.Duration{}, metav1.Duration{}
+	if !reflect.DeepEqual(oldspec, newspec) {
+		return fmt.Errorf("spec is immutable after created, except deletePolicy and trashDeferment")
+	}
+	switch newobj.Spec.DeletePolicy {
+	case "", alcubv1beta1.DeletePolicyDelete, alcubv1beta1.DeletePolicyRetain, alcubv1beta1.DeletePolicyTrash:
+	default:
+		return fmt.Errorf("invalid deletePolicy %s", newobj.Spec.DeletePolicy)
+	}
+	if newobj.Spec.TrashDeferment.Duration < 0 {
+		return fmt.Errorf("trashDeferment must not be negative")
+	}
+	// not attached, or trusted user
+	if oldobj.Status.Node == "" || v.isTrusted(user) {
+		return nil
+	}
+	if oldobj.Status.Node != newobj.Status.Node {
+		return fmt.Errorf("status.node can not be changed when attached on %s", oldobj.Status.Node)
+	}
+	if hasFinalizer(oldobj.Finalizers) && !hasFinalizer(newobj.Finalizers) {
+		return fmt.Errorf("finalizer can not be removed when attached on %s", oldobj.Status.Node)
+	}
+	return nil
+}
+
+func (v *AlcubValidator) isTrusted(user string) bool {
+	return v.trusted.Has(user)
+}
+
+// ServiceAccountUser return username of service account
+func ServiceAccountUser(namespace, name string) string {
+	return serviceAccountPrefix + namespace + ":" + name
+}
+
+func hasFinalizer(fs []string) bool {
+	for _, f := range fs {
+		for _, v := range finalizers {
+			if f == v {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -1,16 +1,28 @@
 package noderpc
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
+	"time"
 
 	alcubv1beta1 "github.com/yylt/csi-alcub/pkg/api/v1beta1"
+	"github.com/yylt/csi-alcub/pkg/cluster"
 	"github.com/yylt/csi-alcub/pkg/manager"
 	rbd2 "github.com/yylt/csi-alcub/pkg/rbd"
 	"github.com/yylt/csi-alcub/pkg/store"
+	mtypes "github.com/yylt/csi-alcub/types"
 	"github.com/yylt/csi-alcub/utils"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
 	klog "k8s.io/klog/v2"
 )
 
@@ -19,6 +31,9 @@ var _ csi.NodeServer = &Node{}
 const (
 	TopologyKeyNode = "topology.alcub.csi/node"
 	defaultPerm     = 0750
+
+	defaultCleanInterval = 2 * time.Second
+	defaultCleanTimeout  = time.Minute
 )
 
 type delfn func()
@@ -37,6 +52,22 @@ type Node struct {
 	nodename string
 
 	storeip string
+
+	// nil if registry not enabled, only the default cluster is used
+	registry *cluster.Registry
+	confmu   sync.Mutex
+	// key: cluster id and alcub settings of volume
+	confs map[string]*store.DynConf
+
+	// wait image clean before attach
+	cleanInterval time.Duration
+	cleanTimeout  time.Duration
+	// flush and wait image clean before detach, flush is not sent
+	// and wait by cleanTimeout when 0
+	flushTimeout time.Duration
+
+	// check previous owner before stop device on it, never stop when nil
+	kubecli kubernetes.Interface
 }
 
 func NewNode(store store.Alcuber, alcubControl *manager.AlcubCon, rbd *rbd2.Rbd, nodename, storeifname string) *Node {
@@ -48,6 +79,8 @@ func NewNode(store store.Alcuber, alcubControl *manager.AlcubCon, rbd *rbd2.Rbd,
 		nodeID:            nodename,
 		nodename:          nodename,
 		storeip:           getStoraIfIp(storeifname),
+		cleanInterval:     defaultCleanInterval,
+		cleanTimeout:      defaultCleanTimeout,
 	}
 	if node.storeip == "" {
 		panic("not found storage ip")
@@ -55,17 +88,102 @@ func NewNode(store store.Alcuber, alcubControl *manager.AlcubCon, rbd *rbd2.Rbd,
 	return node
 }
 
+func (c *Node) SetupWaitClean(interval, timeout time.Duration) {
+	c.cleanInterval = interval
+	c.cleanTimeout = timeout
+}
+
+func (c *Node) SetupFlush(timeout time.Duration) {
+	c.flushTimeout = timeout
+}
+
+func (c *Node) SetupKubeClient(kubecli kubernetes.Interface) {
+	c.kubecli = kubecli
+}
+
+func (c *Node) SetupRegistry(registry *cluster.Registry) {
+	c.registry = registry
+}
+
+// dynConf return dynamic configure of the cluster which volume belongs to,
+// nil means the default cluster
+func (c *Node) dynConf(alcub *alcubv1beta1.CsiAlcub) (*store.DynConf, error) {
+	var (
+		id       = alcub.Spec.ClusterId
+		key      = id
+		override *store.AlcubConf
+		cl       *cluster.Cluster
+		err      error
+	)
+	if s := alcub.Spec.Alcub; s != nil {
+		override = store.NewAlcubConf(s.Pool, s.ApiUrl, s.SecretNamespace, s.SecretName)
+	}
+	if id == "" && override == nil {
+		return nil, nil
+	}
+	if id != "" {
+		if c.registry == nil {
+			return nil, fmt.Errorf("volume belongs to cluster %s, but cluster registry not enabled", id)
+		}
+		cl, err = c.registry.Get(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if override != nil {
+		key = fmt.Sprintf("%s/%s/%s/%s/%s", id, override.AlucbPool, override.ApiUrl, override.SecretNamespace, override.SecretName)
+	}
+	c.confmu.Lock()
+	defer c.confmu.Unlock()
+	if c.confs == nil {
+		c.confs = map[string]*store.DynConf{}
+	}
+	conf, ok := c.confs[key]
+	if !ok || conf.Cluster != cl {
+		// cluster reloaded, the alcub url should be fetched again
+		conf = &store.DynConf{
+			Nodename: c.nodename,
+			Cluster:  cl,
+			Conf:     override,
+		}
+		c.confs[key] = conf
+	}
+	return conf, nil
+}
+
 func (c *Node) detachDevice(alcub *alcubv1beta1.CsiAlcub) error {
-	err := c.store.DoDisConn(nil, alcub.Spec.Pool, alcub.Spec.Image)
+	conf, err := c.dynConf(alcub)
+	if err != nil {
+		return err
+	}
+	err = c.store.DoDisConn(conf, alcub.Spec.Pool, alcub.Spec.Image)
+	if mtypes.AlcubReasonOf(err) == mtypes.AlcubNotFound {
+		// disconnected already, unpublish may be called again
+		klog.Infof("device of pool: %v, image: %v not found: %v", alcub.Spec.Pool, alcub.Spec.Image, err)
+		err = nil
+	}
 	if err != nil {
 		klog.Errorf("detach device failed: %v", err)
+		return err
 	}
 	klog.V(2).Infof("deatach device success pool: %v, image:%v", alcub.Spec.Pool, alcub.Spec.Image)
-	return err
+	return nil
 }
 
 func (c *Node) attachDevice(alcub *alcubv1beta1.CsiAlcub) (string, error) {
-	devpath, err := c.store.DoConn(nil, alcub.Spec.Pool, alcub.Spec.Image)
+	conf, err := c.dynConf(alcub)
+	if err != nil {
+		return "", err
+	}
+	var opts *store.ConnOptions
+	if cache := alcub.Spec.Cache; cache != nil {
+		opts = &store.ConnOptions{
+			CacheMode:     cache.Mode,
+			CacheSize:     cache.Size,
+			CachePriority: cache.Priority,
+		}
+	}
+	devpath, err := c.store.DoConn(conf, alcub.Spec.Pool, alcub.Spec.Image, opts)
 	if err != nil {
 		klog.Errorf("attach device failed: %v", err)
 		return "", err
@@ -97,11 +215,19 @@ func (c *Node) preMountValid(alcub *alcubv1beta1.CsiAlcub) (string, delfn, okfn,
 		klog.Errorf("csialcub(%s) image or pool is null", alcub.Name)
 		return "", nil, nil, fmt.Errorf("image or pool is null")
 	}
+	if alcub.DeletionTimestamp != nil {
+		klog.Errorf("csialcub(%s) is deleting", alcub.Name)
+		return "", nil, nil, fmt.Errorf("volume is deleting")
+	}
 
+	conf, err := c.dynConf(alcub)
+	if err != nil {
+		return "", nil, nil, err
+	}
 	//check image is ready to use
-	if c.store.GetImageStatus(nil, alcub.Spec.Pool, alcub.Spec.Image) == false {
-		klog.Errorf("image(%v) pool(%v) is not ready", alcub.Spec.Pool, alcub.Spec.Image)
-		return "", nil, nil, fmt.Errorf("image(%s) status is not ready, wait clear", alcub.Spec.Image)
+	err = c.waitImageClean(alcub, conf)
+	if err != nil {
+		return "", nil, nil, err
 	}
 
 	if alcub.Status.Node == "" {
@@ -110,7 +236,7 @@ func (c *Node) preMountValid(alcub *alcubv1beta1.CsiAlcub) (string, delfn, okfn,
 	if alcub.Status.Node == c.nodename {
 		okAttach = true
 	}
-	nodes, err = c.store.GetNode(nil, c.nodename)
+	nodes, err = c.store.GetNode(conf, c.nodename)
 	if err != nil {
 		return "", nil, nil, err
 	}
@@ -136,6 +262,7 @@ func (c *Node) preMountValid(alcub *alcubv1beta1.CsiAlcub) (string, delfn, okfn,
 		}
 		alcub.Status.Node = c.nodename
 		alcub.Status.AllNodes = nodes
+		alcub.Status.Message = ""
 		alcub.Status.VolumeInfo = alcubv1beta1.VolumeInfo{
 			Devpath:   dev,
 			StorageIp: c.storeip,
@@ -146,22 +273,197 @@ func (c *Node) preMountValid(alcub *alcubv1beta1.CsiAlcub) (string, delfn, okfn,
 	return dev, faielfunc, successfunc, nil
 }
 
-func (c *Node) preUnmountValid(alcub *alcubv1beta1.CsiAlcub) (delfn, okfn, error) {
+// waitImageClean poll image status until clean. the previous owner is checked
+// on every poll, and the device on it is stopped once the owner failed, so the
+// cache of previous owner is flushed. the healthy owner flush cache when
+// unpublished. busy error is returned when timeout.
+func (c *Node) waitImageClean(alcub *alcubv1beta1.CsiAlcub, conf *store.DynConf) error {
 	var (
-		err error
+		owner   = alcub.Status.Node
+		stopped bool
 	)
+	if owner == c.nodename {
+		owner = ""
+	}
+	last, err := c.pollImageClean(alcub, conf, c.cleanTimeout, func(imgstatus string) {
+		klog.Infof("image(%v) pool(%v) is not ready, status: %v", alcub.Spec.Image, alcub.Spec.Pool, imgstatus)
+		if owner == "" {
+			c.progress(alcub, "WaitImageClean", fmt.Sprintf("waiting for image clean, status: %s", imgstatus))
+			return
+		}
+		if !stopped && !c.ownerFailed(owner) {
+			c.progress(alcub, "WaitOwnerUnpublish", fmt.Sprintf("waiting for volume unpublished from node %s", owner))
+			return
+		}
+		c.progress(alcub, "WaitCacheFlush", fmt.Sprintf("waiting for cache flush from node %s", owner))
+		if !stopped {
+			stopped = c.stopOnOwner(alcub, conf, owner)
+		}
+	})
+	if err == wait.ErrWaitTimeout {
+		msg := fmt.Sprintf("image(%s) status is %s after %v", alcub.Spec.Image, last, c.cleanTimeout)
+		if owner != "" {
+			msg = fmt.Sprintf("waiting for cache flush from node %s timeout, image(%s) status is %s", owner, alcub.Spec.Image, last)
+		}
+		c.alcubControl.Progress(alcub, "WaitCleanTimeout", msg)
+		return mtypes.NewAlcubError(mtypes.AlcubBusy, 0, msg)
+	}
+	return err
+}
+
+// progress record message of alcub when it is changed
+func (c *Node) progress(alcub *alcubv1beta1.CsiAlcub, reason, msg string) {
+	if alcub.Status.Message != msg {
+		c.alcubControl.Progress(alcub, reason, msg)
+	}
+}
+
+// flushDevice flush the cache of device and wait alcub report image clean,
+// so the volume can be used by other node. dev_flush is not sent when
+// disabled or alcub answered it is not supported, but the image must be
+// clean before detach anyway. busy error is returned after timeout.
+func (c *Node) flushDevice(alcub *alcubv1beta1.CsiAlcub, conf *store.DynConf) error {
+	var timeout = c.flushTimeout
+	if timeout <= 0 {
+		timeout = c.cleanTimeout
+	} else {
+		err := c.store.Flush(conf, alcub.Spec.Pool, alcub.Spec.Image)
+		switch {
+		case errors.Is(err, store.ErrUnsupported):
+			klog.Infof("skip flush image(%v) pool(%v), wait image clean: %v", alcub.Spec.Image, alcub.Spec.Pool, err)
+		case mtypes.AlcubReasonOf(err) == mtypes.AlcubNotFound:
+			// disconnected already, unpublish may be called again
+			klog.Infof("device of image(%v) pool(%v) not found, wait image clean: %v", alcub.Spec.Image, alcub.Spec.Pool, err)
+		case err != nil:
+			klog.Errorf("flush image(%v) pool(%v) failed: %v", alcub.Spec.Image, alcub.Spec.Pool, err)
+			return err
+		}
+	}
+	last, err := c.pollImageClean(alcub, conf, timeout, func(imgstatus string) {
+		c.progress(alcub, "WaitFlush", fmt.Sprintf("flushing cache on node %s, status: %s", c.nodename, imgstatus))
+	})
+	if err == wait.ErrWaitTimeout {
+		msg := fmt.Sprintf("dirty data remains on image(%s) after flush %v, status: %s", alcub.Spec.Image, timeout, last)
+		c.alcubControl.Progress(alcub, "FlushTimeout", msg)
+		return mtypes.NewAlcubError(mtypes.AlcubBusy, 0, msg)
+	}
+	if err != nil {
+		return err
+	}
+	klog.V(2).Infof("flush image(%v) pool(%v) success", alcub.Spec.Image, alcub.Spec.Pool)
+	return nil
+}
+
+// pollImageClean poll image status until alcub report it clean or timeout,
+// the status which failed to get is not clean. dirtyfn is called on every
+// poll which image is not clean. return the last status which is not clean
+func (c *Node) pollImageClean(alcub *alcubv1beta1.CsiAlcub, conf *store.DynConf, timeout time.Duration, dirtyfn func(imgstatus string)) (string, error) {
+	var last string
+	err := wait.PollImmediate(c.cleanInterval, timeout, func() (bool, error) {
+		imgstatus, err := c.store.GetImageStatus(conf, alcub.Spec.Pool, alcub.Spec.Image)
+		if err != nil {
+			klog.Errorf("get image(%v) pool(%v) status failed: %v", alcub.Spec.Image, alcub.Spec.Pool, err)
+			imgstatus = fmt.Sprintf("unknown(%s)", mtypes.AlcubReasonOf(err))
+		} else if store.ImageClean(imgstatus) {
+			return true, nil
+		}
+		if dirtyfn != nil {
+			dirtyfn(imgstatus)
+		}
+		last = imgstatus
+		return false, nil
+	})
+	if err == nil && last != "" {
+		klog.Infof("image(%v) pool(%v) is clean", alcub.Spec.Image, alcub.Spec.Pool)
+	}
+	return last, err
+}
+
+// ownerFailed return true if node is not ready or failed in alcub,
+// the device on it can be stopped by others
+func (c *Node) ownerFailed(owner string) bool {
+	if c.kubecli == nil {
+		return false
+	}
+	node, err := c.kubecli.CoreV1().Nodes().Get(context.Background(), owner, metav1.GetOptions{})
+	if err != nil {
+		if apierrs.IsNotFound(err) {
+			return true
+		}
+		klog.Errorf("get node %s failed: %v", owner, err)
+		return false
+	}
+	if node.Annotations[mtypes.NodeMaintainAnnotation] == "true" {
+		return true
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == corev1.TaintNodeUnreachable || taint.Key == corev1.TaintNodeNotReady {
+			return true
+		}
+	}
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeReady {
+			return cond.Status != corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// stop device by alcub url of the previous owner, which found in status zone,
+// return true if stopped or device not found
+func (c *Node) stopOnOwner(alcub *alcubv1beta1.CsiAlcub, conf *store.DynConf, owner string) bool {
+	var ownerconf = store.DynConf{
+		Nodename: owner,
+	}
+	for _, u := range alcub.Status.AllNodes {
+		if strings.Contains(u, owner) {
+			ownerconf.AlucbUrl = []byte(u)
+			break
+		}
+	}
+	if len(ownerconf.AlucbUrl) == 0 {
+		klog.Infof("skip dev stop, because not found alcub url of node %s", owner)
+		return false
+	}
+	if conf != nil {
+		ownerconf.Cluster = conf.Cluster
+		ownerconf.Conf = conf.Conf
+	}
+	err := c.store.DevStop(&ownerconf, alcub.Spec.Pool, alcub.Spec.Image)
+	if mtypes.AlcubReasonOf(err) == mtypes.AlcubNotFound {
+		klog.Infof("skip stop, device of image(%v) not found on node %s", alcub.Spec.Image, owner)
+		return true
+	}
+	if err != nil {
+		klog.Errorf("stop image(%v) on node %s failed: %v", alcub.Spec.Image, owner, err)
+		return false
+	}
+	klog.Infof("stop image(%v) on node %s success", alcub.Spec.Image, owner)
+	return true
+}
+
+func (c *Node) preUnmountValid(alcub *alcubv1beta1.CsiAlcub) (delfn, okfn, error) {
 	klog.V(2).Infof("in preUnmount, %s the volumeInfo is %v", alcub.Name, alcub.Status.VolumeInfo)
 	if alcub.Status.Node != c.nodename {
 		// Not here
 		return nil, nil, fmt.Errorf("node excepte:%v, but here is %v", alcub.Status.Node, c.nodename)
 	}
 	successfunc := func() error {
+		conf, err := c.dynConf(alcub)
+		if err != nil {
+			return err
+		}
+		err = c.flushDevice(alcub, conf)
+		if err != nil {
+			return err
+		}
 		err = c.detachDevice(alcub)
 		if err != nil {
 			//TODO detachDevice func should be idempotent.
 			return err
 		}
 		alcub.Status.Node = ""
+		alcub.Status.Message = ""
 		return c.alcubControl.Update(alcub.Name, nil, &alcub.Status)
 	}
 	return nil, successfunc, nil
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 
+	mtypes "github.com/yylt/csi-alcub/types"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -66,7 +68,7 @@ func (c *Node) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolume
 	//prepare volume
 	devpath, failedfn, successfn, err := c.preMountValid(alcub)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusError(err)
 	}
 	defer func() {
 		if reterr != nil {
@@ -77,7 +79,7 @@ func (c *Node) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolume
 			return
 		}
 		if successfn != nil {
-			rerr = successfn()
+			rerr = statusError(successfn())
 		}
 	}()
 
@@ -149,7 +151,7 @@ func (c *Node) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVo
 
 	failedfn, successfn, err := c.preUnmountValid(alcub)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusError(err)
 	}
 	defer func() {
 		if err != nil {
@@ -160,7 +162,7 @@ func (c *Node) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVo
 			return
 		}
 		if successfn != nil {
-			reterr = successfn()
+			reterr = statusError(successfn())
 		}
 	}()
 	// Unmount only if the target path is really a mount point.
@@ -218,3 +220,14 @@ func (c *Node) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeSta
 func (c *Node) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
 	return nil, status.Error(codes.Unimplemented, "Not impl")
 }
+
+// statusError map alcub error to grpc code, so the sidecars retry the right way
+func statusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Error(mtypes.GrpcCode(err), err.Error())
+}
@@ -0,0 +1,139 @@
+package noderpc
+
+import (
+	"context"
+	"time"
+
+	alcubv1beta1 "github.com/yylt/csi-alcub/pkg/api/v1beta1"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/wait"
+	klog "k8s.io/klog/v2"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	statsLabels = []string{"namespace", "pvc", "pool", "image"}
+
+	cacheHitRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "csi_alcub_cache_hit_ratio",
+		Help: "Read hit ratio of alcub cache device, 0 to 1",
+	}, statsLabels)
+	cacheDirtyBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "csi_alcub_cache_dirty_bytes",
+		Help: "Bytes in alcub cache which not written into ceph",
+	}, statsLabels)
+	cacheDestageBacklog = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "csi_alcub_cache_destage_backlog_bytes",
+		Help: "Bytes waiting for destage into ceph",
+	}, statsLabels)
+	cacheUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "csi_alcub_cache_used_bytes",
+		Help: "Used bytes of alcub cache device",
+	}, statsLabels)
+	cacheSizeBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "csi_alcub_cache_size_bytes",
+		Help: "Total bytes of alcub cache device",
+	}, statsLabels)
+	cacheStatsErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "csi_alcub_cache_stats_errors_total",
+		Help: "Number of failed queries of alcub cache statistics",
+	})
+
+	cacheGauges = []*prometheus.GaugeVec{cacheHitRatio, cacheDirtyBytes, cacheDestageBacklog, cacheUsedBytes, cacheSizeBytes}
+)
+
+func init() {
+	metrics.Registry.MustRegister(cacheHitRatio, cacheDirtyBytes, cacheDestageBacklog, cacheUsedBytes, cacheSizeBytes, cacheStatsErrors)
+}
+
+// Stats query cache statistics of volumes attached on this node,
+// and export them on metrics endpoint of manager
+type Stats struct {
+	node     *Node
+	interval time.Duration
+
+	// label values exported in last scan, key: csialcub name
+	exported map[string][]string
+}
+
+func NewStats(mgr ctrl.Manager, node *Node, interval time.Duration) (*Stats, error) {
+	stats := &Stats{
+		node:     node,
+		interval: interval,
+		exported: map[string][]string{},
+	}
+	return stats, mgr.Add(stats)
+}
+
+// Start implement manager.Runnable
+func (s *Stats) Start(ctx context.Context) error {
+	go wait.Until(s.scan, s.interval, ctx.Done())
+	return nil
+}
+
+// NeedLeaderElection every node export its own volumes
+func (s *Stats) NeedLeaderElection() bool {
+	return false
+}
+
+func (s *Stats) scan() {
+	var (
+		alcubs   []alcubv1beta1.CsiAlcub
+		exported = map[string][]string{}
+	)
+	err := s.node.alcubControl.ForEach(func(a *alcubv1beta1.CsiAlcub) {
+		if a.Status.Node == s.node.nodename && a.DeletionTimestamp == nil {
+			alcubs = append(alcubs, *a)
+		}
+	})
+	if err != nil {
+		klog.Errorf("stats list csialcub failed: %v", err)
+		return
+	}
+	for i := range alcubs {
+		a := &alcubs[i]
+		labels := []string{a.Spec.PvcNamespace, a.Spec.PvcName, a.Spec.Pool, a.Spec.Image}
+		conf, err := s.node.dynConf(a)
+		if err != nil {
+			cacheStatsErrors.Inc()
+			klog.Errorf("stats get configure of %s failed: %v", a.Name, err)
+			continue
+		}
+		stats, err := s.node.store.GetDevStats(conf, a.Spec.Pool, a.Spec.Image)
+		if err != nil {
+			cacheStatsErrors.Inc()
+			klog.V(2).Infof("stats of %s failed: %v", a.Name, err)
+			continue
+		}
+		cacheHitRatio.WithLabelValues(labels...).Set(stats.HitRatio)
+		cacheDirtyBytes.WithLabelValues(labels...).Set(float64(stats.DirtyBytes))
+		cacheDestageBacklog.WithLabelValues(labels...).Set(float64(stats.DestageBacklog))
+		cacheUsedBytes.WithLabelValues(labels...).Set(float64(stats.UsedBytes))
+		cacheSizeBytes.WithLabelValues(labels...).Set(float64(stats.SizeBytes))
+		exported[a.Name] = labels
+	}
+	// the volume detached or stats unavailable, so drop the stale value
+	for name, labels := range s.exported {
+		if cur, ok := exported[name]; ok && equalLabels(cur, labels) {
+			continue
+		}
+		for _, g := range cacheGauges {
+			g.DeleteLabelValues(labels...)
+		}
+	}
+	s.exported = exported
+}
+
+func equalLabels(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -7,6 +7,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/yylt/csi-alcub/pkg/cluster"
+
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/kubernetes"
@@ -16,7 +18,15 @@ import (
 )
 
 var (
-	supportedFeatures = sets.NewString("layering")
+	supportedFeatures = sets.NewString("layering", "exclusive-lock", "object-map", "fast-diff", "deep-flatten")
+	// features which alcub client known to support
+	defaultAllowedFeatures = sets.NewString("layering")
+
+	// key: feature, value: the feature which depended on
+	featureDepends = map[string]string{
+		"object-map": "exclusive-lock",
+		"fast-diff":  "object-map",
+	}
 )
 
 type rbdProvisionOptions struct {
@@ -41,7 +51,8 @@ type rbdProvisionOptions struct {
 	// Ceph RBD image format, "1" or "2". Default is "2".
 	imageFormat string
 	// This parameter is optional and should only be used if you set
-	// imageFormat to "2". Currently supported features are layering only.
+	// imageFormat to "2". Currently supported features are layering,
+	// exclusive-lock, object-map, fast-diff and deep-flatten.
 	// Default is "", and no features are turned on.
 	imageFeatures []string
 }
@@ -58,18 +69,93 @@ type Rbd struct {
 	rbdutil RBDUtil
 
 	dnsip string
+
+	// features which alcub client support, default is layering only
+	allowedFeatures sets.String
+
+	// nil if registry not enabled, only the default cluster is used
+	registry *cluster.Registry
+	// override monitors and admin of storageclass when not nil
+	cluster *cluster.Cluster
 }
 
 // create/delete image function
 // NOTE: Only support storageclass v1
 func NewRbd(client kubernetes.Interface, createTimeout time.Duration) *Rbd {
 	rbd := &Rbd{
-		client:  client,
-		rbdutil: NewRbdUtil(createTimeout),
+		client:          client,
+		rbdutil:         NewRbdUtil(createTimeout),
+		allowedFeatures: defaultAllowedFeatures,
 	}
 	return rbd
 }
 
+// SetAllowedFeatures limit the image features by alcub client capabilities
+func (r *Rbd) SetAllowedFeatures(features []string) error {
+	allowed := sets.NewString()
+	for _, f := range features {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !supportedFeatures.Has(f) {
+			return fmt.Errorf("invalid feature %q, supported features are: %v", f, supportedFeatures.List())
+		}
+		allowed.Insert(f)
+	}
+	r.allowedFeatures = allowed
+	return nil
+}
+
+func (r *Rbd) SetupRegistry(registry *cluster.Registry) {
+	r.registry = registry
+}
+
+// Cluster return rbd of the cluster in registry, the monitors and key of
+// the cluster override the storageclass, which only select pool and image
+// options. the default cluster is used when id is empty
+func (r *Rbd) Cluster(id string) (*Rbd, error) {
+	if id == "" {
+		return r, nil
+	}
+	if r.registry == nil {
+		return nil, fmt.Errorf("cluster %s not supported, cluster registry not enabled", id)
+	}
+	cl, err := r.registry.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	rbd := *r
+	rbd.cluster = cl
+	return &rbd, nil
+}
+
+// validFeatures check the feature is allowed and it's dependency is enabled,
+// only new image is checked, so the existed images can still be deleted
+// after allowed features narrowed
+func (r *Rbd) validFeatures(opts *rbdProvisionOptions) error {
+	var features = opts.imageFeatures
+	if len(features) == 0 {
+		return nil
+	}
+	if opts.imageFormat != rbdImageFormat2 {
+		return fmt.Errorf("image features %v require imageformat %s", features, rbdImageFormat2)
+	}
+	enabled := sets.NewString(features...)
+	for _, f := range features {
+		if !supportedFeatures.Has(f) {
+			return fmt.Errorf("invalid feature %q, supported features are: %v", f, supportedFeatures.List())
+		}
+		if !r.allowedFeatures.Has(f) {
+			return fmt.Errorf("feature %q is not supported by alcub client, allowed features are: %v", f, r.allowedFeatures.List())
+		}
+		if dep, ok := featureDepends[f]; ok && !enabled.Has(dep) {
+			return fmt.Errorf("feature %q requires %q", f, dep)
+		}
+	}
+	return nil
+}
+
 func (r *Rbd) parseParameters(parameters map[string]string) (*rbdProvisionOptions, error) {
 	// options with default values
 	opts := &rbdProvisionOptions{
@@ -147,8 +233,9 @@ func (r *Rbd) parseParameters(parameters map[string]string) (*rbdProvisionOption
 		case "imagefeatures":
 			arr := strings.Split(v, ",")
 			for _, f := range arr {
-				if !supportedFeatures.Has(f) {
-					return nil, fmt.Errorf("invalid feature %q, supported features are: %v", f, supportedFeatures)
+				f = strings.TrimSpace(f)
+				if f == "" {
+					continue
 				}
 				opts.imageFeatures = append(opts.imageFeatures, f)
 			}
@@ -201,27 +288,139 @@ func (r *Rbd) parsePVSecret(namespace, secretName string) (string, error) {
 }
 
 func (r *Rbd) CreateImage(scname string, image string, bytesize int64) (*Volume, error) {
-	ctx := context.Background()
-	sc, err := r.client.StorageV1().StorageClasses().Get(ctx, scname, metav1.GetOptions{})
+	rbdoption, err := r.getOptions(scname)
 	if err != nil {
 		return nil, err
 	}
-	rbdoption, err := r.parseParameters(sc.Parameters)
-	if err != nil {
+	if err = r.validFeatures(rbdoption); err != nil {
 		return nil, err
 	}
 	return r.rbdutil.CreateImage(rbdoption, image, bytesize)
 }
 
 func (r *Rbd) DeleteImage(scname string, image string) error {
+	rbdoption, err := r.getOptions(scname)
+	if err != nil {
+		return err
+	}
+	return r.rbdutil.DeleteImage(rbdoption, image)
+}
+
+func (r *Rbd) SetImageMeta(scname string, image string, meta map[string]string) error {
+	rbdoption, err := r.getOptions(scname)
+	if err != nil {
+		return err
+	}
+	return r.rbdutil.SetImageMeta(rbdoption, image, meta)
+}
+
+func (r *Rbd) GetImageMeta(scname string, image string) (map[string]string, error) {
+	rbdoption, err := r.getOptions(scname)
+	if err != nil {
+		return nil, err
+	}
+	return r.rbdutil.GetImageMeta(rbdoption, image)
+}
+
+// ListImages return the pool and images of the rbd storageclass
+func (r *Rbd) ListImages(scname string) (string, []string, error) {
+	rbdoption, err := r.getOptions(scname)
+	if err != nil {
+		return "", nil, err
+	}
+	images, err := r.rbdutil.ListImages(rbdoption)
+	return rbdoption.pool, images, err
+}
+
+func (r *Rbd) getOptions(scname string) (*rbdProvisionOptions, error) {
 	ctx := context.Background()
 	sc, err := r.client.StorageV1().StorageClasses().Get(ctx, scname, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	opts, err := r.parseParameters(sc.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	if cl := r.cluster; cl != nil {
+		opts.monitors = cl.Monitors
+		opts.adminID = cl.UserId
+		opts.adminSecret = cl.Key
+		opts.userID = cl.UserId
+	}
+	return opts, nil
+}
+
+// TrashImage move image into trash, and it will be purged after deferment
+func (r *Rbd) TrashImage(scname string, image string, deferment time.Duration) error {
+	rbdoption, err := r.getOptions(scname)
 	if err != nil {
 		return err
 	}
-	rbdoption, err := r.parseParameters(sc.Parameters)
+	return r.rbdutil.TrashImage(rbdoption, image, time.Now().Add(deferment))
+}
+
+// TrashRemove remove the expired image in trash by id
+func (r *Rbd) TrashRemove(scname string, id string) error {
+	rbdoption, err := r.getOptions(scname)
 	if err != nil {
 		return err
 	}
-	return r.rbdutil.DeleteImage(rbdoption, image)
+	return r.rbdutil.TrashRemove(rbdoption, id)
+}
+
+// ImageId return the pool and id of image, id is empty if image not found
+func (r *Rbd) ImageId(scname string, image string) (string, string, error) {
+	rbdoption, err := r.getOptions(scname)
+	if err != nil {
+		return "", "", err
+	}
+	id, err := r.rbdutil.ImageId(rbdoption, image)
+	return rbdoption.pool, id, err
+}
+
+// TrashList return the pool and trash entries of the rbd storageclass
+func (r *Rbd) TrashList(scname string) (string, []TrashEntry, error) {
+	rbdoption, err := r.getOptions(scname)
+	if err != nil {
+		return "", nil, err
+	}
+	entries, err := r.rbdutil.TrashList(rbdoption)
+	return rbdoption.pool, entries, err
+}
+
+// TrashRestore restore image by trash id, and return the volume and size
+func (r *Rbd) TrashRestore(scname string, id, image string) (*Volume, int64, error) {
+	rbdoption, err := r.getOptions(scname)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = r.rbdutil.TrashRestore(rbdoption, id, image)
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := r.rbdutil.ImageSize(rbdoption, image)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &Volume{
+		Pool:  rbdoption.pool,
+		Image: image,
+	}, size, nil
+}
+
+// ImageInfo return the volume and size of existed image
+func (r *Rbd) ImageInfo(scname string, image string) (*Volume, int64, error) {
+	rbdoption, err := r.getOptions(scname)
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := r.rbdutil.ImageSize(rbdoption, image)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &Volume{
+		Pool:  rbdoption.pool,
+		Image: image,
+	}, size, nil
 }
@@ -2,6 +2,7 @@ package rbd
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
@@ -21,6 +22,7 @@ const (
 	secretKeyName   = "key" // key name used in secret
 	rbdImageFormat1 = "1"
 	rbdImageFormat2 = "2"
+	trashTimeFormat = "2006-01-02 15:04:05"
 )
 
 var (
@@ -29,6 +31,16 @@ var (
 
 var errHadDeleted = errors.New("had deleted")
 
+// output of "rbd trash ls --long --format json"
+type TrashEntry struct {
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	Source    string `json:"source"`
+	DeletedAt string `json:"deleted_at"`
+	// such as: protected until ...
+	Status string `json:"status"`
+}
+
 type RBDUtil time.Duration
 
 func NewRbdUtil(du time.Duration) RBDUtil {
@@ -151,11 +163,179 @@ func (u RBDUtil) DeleteImage(pOpts *rbdProvisionOptions, image string) error {
 	return err
 }
 
-func (u RBDUtil) FetchUrl(pool, attr string) ([]byte, error) {
+// TrashImage move image into trash, it can be purged after expires
+func (u RBDUtil) TrashImage(pOpts *rbdProvisionOptions, image string, expires time.Time) error {
+	found, err := u.rbdStatus(image, pOpts)
+	if err == errHadDeleted {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if found {
+		klog.Info("rbd is still being used ", image)
+		return fmt.Errorf("rbd %s is still being used", image)
+	}
+	mon := u.kernelRBDMonitorsOpt(pOpts.monitors)
+	expiresAt := expires.UTC().Format(trashTimeFormat)
+	klog.V(4).Infof("rbd: trash mv %s expires at %s using mon %s, pool %s id %s", image, expiresAt, mon, pOpts.pool, pOpts.adminID)
+	args := []string{"trash", "mv", image, "--expires-at", expiresAt, "--pool", pOpts.pool, "--id", pOpts.adminID, "-m", mon, "--key=" + pOpts.adminSecret}
+	output, err := u.execCommand("rbd", args)
+	if err != nil {
+		klog.Errorf("failed to move rbd image into trash: %v, command output: %s", err, string(output))
+		return err
+	}
+	return nil
+}
+
+// TrashRemove remove the image in trash by id, it fails if not expired.
+// nil is returned if not found, which is restored or removed by others
+func (u RBDUtil) TrashRemove(pOpts *rbdProvisionOptions, id string) error {
+	mon := u.kernelRBDMonitorsOpt(pOpts.monitors)
+	klog.V(4).Infof("rbd: trash rm %s using mon %s, pool %s id %s", id, mon, pOpts.pool, pOpts.adminID)
+	args := []string{"trash", "rm", id, "--pool", pOpts.pool, "--id", pOpts.adminID, "-m", mon, "--key=" + pOpts.adminSecret}
+	output, err := u.execCommand("rbd", args)
+	if err != nil {
+		if strings.Contains(string(output), imageNotFound) {
+			return nil
+		}
+		klog.Errorf("failed to remove rbd image from trash: %v, command output: %s", err, string(output))
+		return err
+	}
+	return nil
+}
+
+// TrashList return the trash entries in the pool
+func (u RBDUtil) TrashList(pOpts *rbdProvisionOptions) ([]TrashEntry, error) {
+	var entries []TrashEntry
+	mon := u.kernelRBDMonitorsOpt(pOpts.monitors)
+	args := []string{"trash", "ls", "--long", "--format", "json", "--pool", pOpts.pool, "--id", pOpts.adminID, "-m", mon, "--key=" + pOpts.adminSecret}
+	output, err := u.execCommand("rbd", args)
+	if err != nil {
+		klog.Errorf("failed to list rbd trash: %v, command output: %s", err, string(output))
+		return nil, err
+	}
+	err = json.Unmarshal(output, &entries)
+	return entries, err
+}
+
+// TrashRestore restore image from trash by id with new name
+func (u RBDUtil) TrashRestore(pOpts *rbdProvisionOptions, id, image string) error {
+	mon := u.kernelRBDMonitorsOpt(pOpts.monitors)
+	klog.V(4).Infof("rbd: trash restore %s to %s using mon %s, pool %s id %s", id, image, mon, pOpts.pool, pOpts.adminID)
+	args := []string{"trash", "restore", id, "--image", image, "--pool", pOpts.pool, "--id", pOpts.adminID, "-m", mon, "--key=" + pOpts.adminSecret}
+	output, err := u.execCommand("rbd", args)
+	if err != nil {
+		klog.Errorf("failed to restore rbd image: %v, command output: %s", err, string(output))
+		return err
+	}
+	return nil
+}
+
+// ImageId return the id of image, which is used in trash.
+// empty id is returned if image not found
+func (u RBDUtil) ImageId(pOpts *rbdProvisionOptions, image string) (string, error) {
+	var info = struct {
+		Id string `json:"id"`
+	}{}
+	mon := u.kernelRBDMonitorsOpt(pOpts.monitors)
+	args := []string{"info", image, "--format", "json", "--pool", pOpts.pool, "--id", pOpts.adminID, "-m", mon, "--key=" + pOpts.adminSecret}
+	output, err := u.execCommand("rbd", args)
+	if err != nil {
+		if strings.Contains(string(output), imageNotFound) {
+			return "", nil
+		}
+		klog.Errorf("failed to get rbd image info: %v, command output: %s", err, string(output))
+		return "", err
+	}
+	err = json.Unmarshal(output, &info)
+	if err != nil {
+		return "", err
+	}
+	if info.Id == "" {
+		return "", fmt.Errorf("image %s has no id, trash require image format %s", image, rbdImageFormat2)
+	}
+	return info.Id, nil
+}
+
+// ImageSize return the image size in bytes
+func (u RBDUtil) ImageSize(pOpts *rbdProvisionOptions, image string) (int64, error) {
+	var info = struct {
+		Size int64 `json:"size"`
+	}{}
+	mon := u.kernelRBDMonitorsOpt(pOpts.monitors)
+	args := []string{"info", image, "--format", "json", "--pool", pOpts.pool, "--id", pOpts.adminID, "-m", mon, "--key=" + pOpts.adminSecret}
+	output, err := u.execCommand("rbd", args)
+	if err != nil {
+		klog.Errorf("failed to get rbd image info: %v, command output: %s", err, string(output))
+		return 0, err
+	}
+	err = json.Unmarshal(output, &info)
+	return info.Size, err
+}
+
+// SetImageMeta set key-value into image metadata
+func (u RBDUtil) SetImageMeta(pOpts *rbdProvisionOptions, image string, meta map[string]string) error {
+	mon := u.kernelRBDMonitorsOpt(pOpts.monitors)
+	for k, v := range meta {
+		klog.V(4).Infof("rbd: image-meta set %s %s=%s using mon %s, pool %s id %s", image, k, v, mon, pOpts.pool, pOpts.adminID)
+		args := []string{"image-meta", "set", image, k, v, "--pool", pOpts.pool, "--id", pOpts.adminID, "-m", mon, "--key=" + pOpts.adminSecret}
+		output, err := u.execCommand("rbd", args)
+		if err != nil {
+			klog.Errorf("failed to set rbd image meta: %v, command output: %s", err, string(output))
+			return err
+		}
+	}
+	return nil
+}
+
+// GetImageMeta return all key-value in image metadata
+func (u RBDUtil) GetImageMeta(pOpts *rbdProvisionOptions, image string) (map[string]string, error) {
+	var meta = map[string]string{}
+	mon := u.kernelRBDMonitorsOpt(pOpts.monitors)
+	args := []string{"image-meta", "list", image, "--format", "json", "--pool", pOpts.pool, "--id", pOpts.adminID, "-m", mon, "--key=" + pOpts.adminSecret}
+	output, err := u.execCommand("rbd", args)
+	if err != nil {
+		klog.Errorf("failed to list rbd image meta: %v, command output: %s", err, string(output))
+		return nil, err
+	}
+	// output is empty when no metadata
+	if len(strings.TrimSpace(string(output))) == 0 {
+		return meta, nil
+	}
+	err = json.Unmarshal(output, &meta)
+	return meta, err
+}
+
+// ListImages list all images in the pool
+func (u RBDUtil) ListImages(pOpts *rbdProvisionOptions) ([]string, error) {
+	var images []string
+	mon := u.kernelRBDMonitorsOpt(pOpts.monitors)
+	klog.V(4).Infof("rbd: ls using mon %s, pool %s id %s", mon, pOpts.pool, pOpts.adminID)
+	args := []string{"ls", "--pool", pOpts.pool, "--id", pOpts.adminID, "-m", mon, "--key=" + pOpts.adminSecret}
+	output, err := u.execCommand("rbd", args)
+	if err != nil {
+		klog.Errorf("failed to list rbd image: %v, command output: %s", err, string(output))
+		return nil, err
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			images = append(images, line)
+		}
+	}
+	return images, nil
+}
+
+// mons, id and key are optional, use ceph.conf if mons is empty
+func (u RBDUtil) FetchUrl(pool, attr string, mons []string, id, key string) ([]byte, error) {
 	if pool == "" || attr == "" {
 		return nil, fmt.Errorf("pool or attr not define")
 	}
 	args := []string{"-p", pool, "getxattr", attr, "URL"}
+	if len(mons) != 0 {
+		args = append(args, "-m", u.kernelRBDMonitorsOpt(mons), "--id", id, "--key="+key)
+	}
 	return u.execCommand("rados", args)
 }
 
@@ -203,7 +383,12 @@ func (u RBDUtil) execCommand(command string, args []string) ([]byte, error) {
 
 //command: rados -p {pool} getxattr {attr} URL
 func FetchUrl(pool, attr string) ([]byte, error) {
-	return defaultRbdUtil.FetchUrl(pool, attr)
+	return defaultRbdUtil.FetchUrl(pool, attr, nil, "", "")
+}
+
+//command: rados -p {pool} getxattr {attr} URL -m {mons} --id {id} --key={key}
+func FetchClusterUrl(pool, attr string, mons []string, id, key string) ([]byte, error) {
+	return defaultRbdUtil.FetchUrl(pool, attr, mons, id, key)
 }
 
 //commmand: ceph --id {id} osd blacklis add {ip}:0/0
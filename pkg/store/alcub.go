@@ -2,28 +2,52 @@ package store
 
 import (
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/yylt/csi-alcub/pkg/cluster"
 	rbd2 "github.com/yylt/csi-alcub/pkg/rbd"
+	mtypes "github.com/yylt/csi-alcub/types"
 	"github.com/yylt/csi-alcub/utils"
 
 	"github.com/imroc/req"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
 	klog "k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 )
 
 var _ Alcuber = &client{}
 
+var activeUrl = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "csi_alcub_active_url",
+	Help: "Alcub url which used by node, the value is always 1",
+}, []string{"node", "cluster", "url"})
+
+func init() {
+	metrics.Registry.MustRegister(activeUrl)
+}
+
 const (
 	resource = "dev"
 	devpath  = "/dev"
+
+	ImageStatusClean = "clean"
 )
 
 var (
+	// the operation is not in operations answered by alcub server
+	ErrUnsupported = errors.New("operation not supported by alcub")
+
 	defaultHeader = http.Header{
 		"content-type": []string{"application/json"},
 		"Accept":       []string{"application/json"},
@@ -33,35 +57,203 @@ var (
 type AlcubConf struct {
 	AlucbPool string
 	ApiUrl    string
-	User      string
-	Password  string
+	// deprecated, used when Credential is nil
+	User     string
+	Password string
+
+	Credential CredentialSource
+	// basic md5 with credential is used when nil
+	Auth Authenticator
+	// CA bundle and client certificate of https alcub url
+	TLSConfig *tls.Config
+	// interval of fetch alcub url of node again, disabled when 0
+	UrlRefresh time.Duration
+	// auto, v1 or v2, auto negotiate with server
+	ApiVersion string
+
+	// secret which include username and password, only used in DynConf
+	SecretName      string
+	SecretNamespace string
 }
 
-// dynamic configure
+// dynamic configure, which is shared by concurrent calls,
+// the urls must not be changed by caller after used
 type DynConf struct {
 	//set by function FinishAlcubUrl()
 	AlucbUrl []byte
 
 	Nodename string
+
+	// nil means the default cluster, which use ceph.conf and alcub pool in AlcubConf
+	Cluster *cluster.Cluster
+
+	// override the client configure when field is not empty
+	Conf *AlcubConf
+
+	// set by GetNode, used when AlucbUrl failed
+	SecondaryUrls []string
+
+	// zero if AlucbUrl is set by caller, which will not be refreshed
+	fetchTime time.Time
+	// background refresh is running
+	refreshing bool
+
+	// protect AlucbUrl, SecondaryUrls, fetchTime and refreshing
+	mu sync.Mutex
+	// only one call fetch url from rados at the same time
+	fetchmu sync.Mutex
+}
+
+// urls return alcub url, secondary urls and fetch time
+func (d *DynConf) urls() (string, []string, time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return string(d.AlucbUrl), d.SecondaryUrls, d.fetchTime
+}
+
+// setUrl update alcub url which fetched by client, return the old url
+func (d *DynConf) setUrl(alcuburl []byte) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	old := d.AlucbUrl
+	d.AlucbUrl = alcuburl
+	d.fetchTime = time.Now()
+	return old
+}
+
+func (d *DynConf) setSecondaryUrls(urls []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.SecondaryUrls = urls
+}
+
+// startRefresh return false if background refresh is running
+func (d *DynConf) startRefresh() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.refreshing {
+		return false
+	}
+	d.refreshing = true
+	return true
+}
+
+func (d *DynConf) endRefresh() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.refreshing = false
+}
+
+// NewAlcubConf return nil if all fields are empty
+func NewAlcubConf(pool, apiurl, secretNamespace, secretName string) *AlcubConf {
+	if pool == "" && apiurl == "" && secretName == "" {
+		return nil
+	}
+	return &AlcubConf{
+		AlucbPool:       pool,
+		ApiUrl:          apiurl,
+		SecretName:      secretName,
+		SecretNamespace: secretNamespace,
+	}
 }
 
 type client struct {
-	cli  *req.Req
-	conf *AlcubConf
+	cli        *req.Req
+	conf       *AlcubConf
+	breaker    *breaker
+	negotiator *negotiator
 
 	dynConf *DynConf
+
+	// credentials of secret in DynConf, key: namespace/name
+	kubecli     kubernetes.Interface
+	credRefresh time.Duration
+	credmu      sync.Mutex
+	creds       map[string]CredentialSource
+}
+
+// retry policy of alcub operation
+type retryPolicy struct {
+	attempts int
+	// try secondary urls when failed
+	failover bool
+	// try the url fetched again when all attempts failed, must not be
+	// set if the request may not be sent twice
+	redirect bool
+	// result is not recorded by breaker, and skipped when circuit open
+	passive bool
+}
+
+var (
+	// dev_connect may connect twice, only called once
+	once = retryPolicy{attempts: 1}
+	// must be done by the alcub url, such as dev_stop on the host
+	local      = retryPolicy{attempts: 3, redirect: true}
+	idempotent = retryPolicy{attempts: 3, failover: true, redirect: true}
+	// background query such as cache statistics, should not open circuit
+	passive = retryPolicy{attempts: 1, passive: true}
+
+	retryBaseDelay = time.Second
+	retryJitter    = 0.5
+)
+
+// transport error, the alcub server is unreachable
+func unavailable(err error) error {
+	return mtypes.NewAlcubError(mtypes.AlcubUnavailable, 0, err.Error())
+}
+
+// checkResp return alcub error if http status code is not ok
+func checkResp(resp *req.Resp) error {
+	if resp == nil || resp.Response() == nil {
+		return mtypes.NewAlcubError(mtypes.AlcubUnavailable, 0, "no response")
+	}
+	code := resp.Response().StatusCode
+	if code < http.StatusBadRequest {
+		return nil
+	}
+	var errbody = struct {
+		Serr string `json:"error,omitempty"`
+	}{}
+	msg := resp.String()
+	if resp.ToJSON(&errbody) == nil && errbody.Serr != "" {
+		msg = errbody.Serr
+	}
+	return mtypes.ParseAlcubError(code, msg)
+}
+
+// permanent error is reported by alcub server, should not retry
+func permanent(err error) bool {
+	var aerr *mtypes.AlcubError
+	if errors.Is(err, ErrUnsupported) {
+		return true
+	}
+	return errors.As(err, &aerr) && aerr.Reason != mtypes.AlcubUnavailable
 }
 
 func NewClient(alcubConf *AlcubConf, dynconf *DynConf, conntimeout time.Duration) *client {
 	if alcubConf == nil || alcubConf.ApiUrl == "" {
 		panic("alcub configure must not be nil and apiurl must not be nil")
 	}
+	switch alcubConf.ApiVersion {
+	case "", ApiVersionAuto, ApiVersionV1, ApiVersionV2:
+	default:
+		panic(fmt.Sprintf("unknown alcub api version %s", alcubConf.ApiVersion))
+	}
 	reqcli := req.New()
 	reqcli.SetTimeout(conntimeout)
+	if alcubConf.TLSConfig != nil {
+		trans, ok := reqcli.Client().Transport.(*http.Transport)
+		if !ok {
+			panic("alcub http transport not found")
+		}
+		trans.TLSClientConfig = alcubConf.TLSConfig
+	}
 	cli := &client{
-		cli:     reqcli,
-		conf:    alcubConf,
-		dynConf: dynconf,
+		cli:        reqcli,
+		conf:       alcubConf,
+		breaker:    newBreaker(breakerThreshold, breakerCooldown),
+		negotiator: newNegotiator(reqcli, alcubConf.ApiVersion),
+		dynConf:    dynconf,
 	}
 	if cli.dynConf != nil {
 		err := cli.fillAlcubUrl(cli.dynConf)
@@ -73,7 +265,60 @@ func NewClient(alcubConf *AlcubConf, dynconf *DynConf, conntimeout time.Duration
 	return cli
 }
 
-func (c *client) DoConn(conf *DynConf, pool, image string) (string, error) {
+// SetupSecrets enable secret in DynConf, the credential is reloaded after refresh
+func (c *client) SetupSecrets(kubecli kubernetes.Interface, refresh time.Duration) {
+	c.kubecli = kubecli
+	c.credRefresh = refresh
+}
+
+// secretCredential return the cached credential of secret
+func (c *client) secretCredential(namespace, name string) CredentialSource {
+	key := namespace + "/" + name
+	c.credmu.Lock()
+	defer c.credmu.Unlock()
+	if cred, ok := c.creds[key]; ok {
+		return cred
+	}
+	if c.kubecli == nil {
+		return &cachedCredential{
+			name: key,
+			load: func() (string, string, error) {
+				return "", "", fmt.Errorf("kubernetes client not setup")
+			},
+		}
+	}
+	if c.creds == nil {
+		c.creds = map[string]CredentialSource{}
+	}
+	cred := NewSecretCredential(c.kubecli, namespace, name, c.credRefresh)
+	c.creds[key] = cred
+	return cred
+}
+
+// ConnOptions is options of dev_connect, zero value means alcub default
+type ConnOptions struct {
+	CacheMode     string
+	CacheSize     int64
+	CachePriority int32
+}
+
+// args of dev_connect
+func (o *ConnOptions) args(data map[string]string) {
+	if o == nil {
+		return
+	}
+	if o.CacheMode != "" {
+		data["cache_mode"] = o.CacheMode
+	}
+	if o.CacheSize > 0 {
+		data["cache_size"] = strconv.FormatInt(o.CacheSize, 10)
+	}
+	if o.CachePriority > 0 {
+		data["cache_priority"] = strconv.Itoa(int(o.CachePriority))
+	}
+}
+
+func (c *client) DoConn(conf *DynConf, pool, image string, opts *ConnOptions) (string, error) {
 	var (
 		reterr   error
 		httpcode int
@@ -81,27 +326,22 @@ func (c *client) DoConn(conf *DynConf, pool, image string) (string, error) {
 	var devbody = struct {
 		Dev string `json:"alcubierre_dev"`
 	}{}
-	reterr = c.do(conf, func(buf *bytes.Buffer, au http.Header, dc *DynConf) error {
-		data := map[string]interface{}{
-			"op": "dev_connect",
-			"op_args": map[string]string{
-				"pool":  pool,
-				"image": image,
-			},
+	reterr = c.do(conf, once, func(ep *endpoint, dc *DynConf) error {
+		data := map[string]string{
+			"pool":  pool,
+			"image": image,
 		}
+		opts.args(data)
 		klog.V(5).Infof("start do connect alcubierre server")
-		resp, err := c.cli.Post(buf.String(), au, defaultHeader, req.BodyJSON(data))
+		resp, err := c.send(ep, opConnect, data)
 		if err != nil {
 			klog.Errorf("do connect failed:%v, data:%v", err, data)
 			return err
 		}
-
-		if resp != nil && resp.Response() != nil {
-			httpcode = resp.Response().StatusCode
-			err = resp.ToJSON(&devbody)
-			if err != nil {
-				klog.Errorf("resp body toJson failed: %v", err)
-			}
+		httpcode = resp.Response().StatusCode
+		err = resp.ToJSON(&devbody)
+		if err != nil {
+			klog.Errorf("resp body toJson failed: %v", err)
 		}
 		klog.V(2).Infof("do connect done, data:%v, code: %v, dev: %v", data, httpcode, devbody.Dev)
 		return err
@@ -115,20 +355,18 @@ func (c *client) DoConn(conf *DynConf, pool, image string) (string, error) {
 	return path.Join(devpath, devbody.Dev), nil
 }
 
+// DoDisConn must be done by the alcub of the host which device connected
 func (c *client) DoDisConn(conf *DynConf, pool, image string) error {
 	var errbody = struct {
 		Serr string `json:"error,omitempty"`
 	}{}
-	return c.do(conf, func(buf *bytes.Buffer, au http.Header, dc *DynConf) error {
-		data := map[string]interface{}{
-			"op": "dev_disconnect",
-			"op_args": map[string]string{
-				"pool":  pool,
-				"image": image,
-			},
+	return c.do(conf, local, func(ep *endpoint, dc *DynConf) error {
+		data := map[string]string{
+			"pool":  pool,
+			"image": image,
 		}
 		klog.V(5).Infof("start do disconnect alcubierre server")
-		resp, err := c.cli.Post(buf.String(), au, defaultHeader, req.BodyJSON(data))
+		resp, err := c.send(ep, opDisconnect, data)
 		if err != nil {
 			klog.Errorf("do disconnect failed: %v", err)
 			return err
@@ -142,7 +380,7 @@ func (c *client) DoDisConn(conf *DynConf, pool, image string) error {
 
 		if errbody.Serr != "" {
 			klog.Errorf("do disconnect failed: %v", errbody.Serr)
-			return errors.New(errbody.Serr)
+			return mtypes.ParseAlcubError(httpcode, errbody.Serr)
 		}
 
 		return nil
@@ -151,59 +389,65 @@ func (c *client) DoDisConn(conf *DynConf, pool, image string) error {
 
 func (c *client) FailNode(conf *DynConf, node string) error {
 
-	return c.do(conf, func(buf *bytes.Buffer, au http.Header, dc *DynConf) error {
+	return c.do(conf, idempotent, func(ep *endpoint, dc *DynConf) error {
 
-		data := map[string]interface{}{
-			"op": "node_fail",
-			"op_args": map[string]string{
-				"node": node,
-			},
+		data := map[string]string{
+			"node": node,
 		}
 		klog.V(5).Infof("start fail node from alcub: %v", data)
-		resp, err := c.cli.Post(buf.String(), au, defaultHeader, req.BodyJSON(data))
+		resp, err := c.send(ep, opNodeFail, data)
 
 		klog.V(2).Infof("fail node done,resp:%v err:%v", resp, err)
-		if err != nil {
-			return err
-		}
-		return nil
+		return err
 	})
 }
 
 func (c *client) DevStop(conf *DynConf, pool, image string) error {
-	return c.do(conf, func(buf *bytes.Buffer, au http.Header, dc *DynConf) error {
+	return c.do(conf, local, func(ep *endpoint, dc *DynConf) error {
 
-		data := map[string]interface{}{
-			"op": "dev_stop",
-			"op_args": map[string]string{
-				"pool":  pool,
-				"image": image,
-			},
+		data := map[string]string{
+			"pool":  pool,
+			"image": image,
 		}
 		klog.V(5).Infof("start dev stop from alcub")
-		resp, err := c.cli.Post(buf.String(), au, defaultHeader, req.BodyJSON(data))
+		resp, err := c.send(ep, opStop, data)
 
 		klog.V(2).Infof("dev stop done,resp:%v err:%v", resp, err)
-		if err != nil {
-			return err
+		return err
+	})
+}
+
+// Flush must be done by the alcub of the host which device connected,
+// ErrUnsupported is returned if alcub answered dev_flush is not supported
+func (c *client) Flush(conf *DynConf, pool, image string) error {
+	return c.do(conf, local, func(ep *endpoint, dc *DynConf) error {
+		if !c.negotiator.Supported(ep.api, ep.auth, opFlush) {
+			return fmt.Errorf("%w: %s", ErrUnsupported, opFlush)
 		}
-		return nil
+		data := map[string]string{
+			"pool":  pool,
+			"image": image,
+		}
+		klog.V(5).Infof("start flush from alcub")
+		resp, err := c.send(ep, opFlush, data)
+
+		klog.V(2).Infof("flush done,resp:%v err:%v", resp, err)
+		return err
 	})
 }
 
-// GetImageStatus
-// return isclear
-func (c *client) GetImageStatus(conf *DynConf, pool, image string) bool {
+// GetImageStatus return status of image, which is clean when ImageClean() is true
+func (c *client) GetImageStatus(conf *DynConf, pool, image string) (string, error) {
 
 	var clearbody = struct {
 		Status string `json:"status,omitempty"`
 	}{}
-	reterr := c.do(conf, func(buf *bytes.Buffer, au http.Header, dc *DynConf) error {
-		data := map[string]interface{}{
+	reterr := c.do(conf, idempotent, func(ep *endpoint, dc *DynConf) error {
+		data := map[string]string{
 			"pool":  pool,
 			"image": image,
 		}
-		resp, err := c.cli.Get(buf.String(), au, defaultHeader, req.BodyJSON(data))
+		resp, err := c.send(ep, opImageStatus, data)
 		if err != nil {
 			klog.Errorf("Get image(%s) status failed:%v", image, err)
 			return err
@@ -218,12 +462,50 @@ func (c *client) GetImageStatus(conf *DynConf, pool, image string) bool {
 		return nil
 	})
 	if reterr != nil {
-		return false
+		return "", reterr
 	}
-	if clearbody.Status == "" || clearbody.Status == "clean" {
-		return true
+	return clearbody.Status, nil
+}
+
+// DevStats is cache statistics of device
+type DevStats struct {
+	// hit ratio of read, 0 to 1
+	HitRatio float64 `json:"hit_ratio"`
+	// bytes in cache, which not written into ceph
+	DirtyBytes int64 `json:"dirty_bytes"`
+	// bytes waiting for destage into ceph
+	DestageBacklog int64 `json:"destage_backlog"`
+	// used and total bytes of cache
+	UsedBytes int64 `json:"used_bytes"`
+	SizeBytes int64 `json:"size_bytes"`
+}
+
+// GetDevStats return cache statistics of device, which is only
+// known by alcub of the node which device attached
+func (c *client) GetDevStats(conf *DynConf, pool, image string) (*DevStats, error) {
+	var stats = &DevStats{}
+	reterr := c.do(conf, passive, func(ep *endpoint, dc *DynConf) error {
+		data := map[string]string{
+			"pool":  pool,
+			"image": image,
+		}
+		resp, err := c.send(ep, opDevStats, data)
+		if err != nil {
+			klog.Errorf("Get device(%s) stats failed:%v", image, err)
+			return err
+		}
+		klog.V(5).Infof("Get device stats done, data:%v, resp:%v", data, resp.String())
+		return resp.ToJSON(stats)
+	})
+	if reterr != nil {
+		return nil, reterr
 	}
-	return false
+	return stats, nil
+}
+
+// ImageClean return true if image can be connected
+func ImageClean(status string) bool {
+	return status == "" || status == ImageStatusClean
 }
 
 // Actually getNode fetch other nodes alcub Url
@@ -233,17 +515,13 @@ func (c *client) GetNode(conf *DynConf, nodename string) ([]string, error) {
 		nodes  []string
 		reterr error
 	)
-	reterr = c.do(conf, func(buf *bytes.Buffer, au http.Header, dc *DynConf) error {
+	reterr = c.do(conf, idempotent, func(ep *endpoint, dc *DynConf) error {
 
-		data := map[string]interface{}{
-			"op": "get_secondary_urls",
-			"op_args": map[string]string{
-				"node": nodename,
-			},
+		data := map[string]string{
+			"node": nodename,
 		}
 		klog.V(5).Infof("start get node from alcub")
-		resp, err := c.cli.Post(buf.String(), au, defaultHeader, req.BodyJSON(data))
-
+		resp, err := c.send(ep, opSecondaryUrls, data)
 		if err != nil {
 			klog.Errorf("Get node failed:%v", err)
 			return err
@@ -254,10 +532,12 @@ func (c *client) GetNode(conf *DynConf, nodename string) ([]string, error) {
 			klog.Errorf("To json data faield:%v", err)
 			return err
 		}
-		alcubu, err := url.Parse(string(dc.AlucbUrl))
+		alcuburl, _, _ := dc.urls()
+		alcubu, err := url.Parse(alcuburl)
 		if err != nil {
 			return nil
 		}
+		dc.setSecondaryUrls(append([]string(nil), nodes...))
 		//TODO evict same node
 		nodes = append(nodes, string(utils.Combine(alcubu.Scheme, "://", alcubu.Host)))
 		klog.V(4).Infof("Get all node: %v", nodes)
@@ -269,11 +549,13 @@ func (c *client) GetNode(conf *DynConf, nodename string) ([]string, error) {
 	return nodes, nil
 }
 
-func (c *client) do(dynconf *DynConf, fn func(buf *bytes.Buffer, au http.Header, c *DynConf) error) error {
+func (c *client) do(dynconf *DynConf, policy retryPolicy, fn func(ep *endpoint, dc *DynConf) error) error {
 	var (
-		auth  http.Header
-		err   error
-		dconf *DynConf
+		auth   http.Header
+		err    error
+		dconf  *DynConf
+		delay  = retryBaseDelay
+		reterr error
 	)
 	if dynconf == nil && c.dynConf == nil {
 		return fmt.Errorf("No dynmic Configure found")
@@ -284,35 +566,263 @@ func (c *client) do(dynconf *DynConf, fn func(buf *bytes.Buffer, au http.Header,
 		dconf = c.dynConf
 	}
 
-	if len(dconf.AlucbUrl) == 0 {
-		err = c.fillAlcubUrl(dconf)
+	alcuburl, secondary, fetchTime := dconf.urls()
+	if alcuburl == "" {
+		err = c.fetchUrl(dconf, fetchTime)
 		if err != nil {
 			return err
 		}
+		alcuburl, secondary, fetchTime = dconf.urls()
+	} else if c.conf.UrlRefresh > 0 && !fetchTime.IsZero() && time.Since(fetchTime) > c.conf.UrlRefresh {
+		// the stale url is used until refreshed in background
+		c.refreshUrl(dconf, fetchTime)
 	}
-	if c.conf.User != "" {
-		auth = utils.BuildBasicAuthMd5([]byte(c.conf.User), []byte(c.conf.Password))
+	conf, err := c.confOf(dconf)
+	if err != nil {
+		return err
 	}
-	dst, err := url.Parse(string(dconf.AlucbUrl))
+	auth, err = authOf(conf).Header()
+	if err != nil {
+		return err
+	}
+	urls := []string{alcuburl}
+	if policy.failover {
+		for _, u := range secondary {
+			if u != urls[0] {
+				urls = append(urls, u)
+			}
+		}
+	}
+	for i := 0; i < policy.attempts; i++ {
+		if i > 0 {
+			time.Sleep(wait.Jitter(delay, retryJitter))
+			delay *= 2
+		}
+		for _, u := range urls {
+			done, err := c.tryUrl(u, policy, conf, auth, dconf, fn)
+			if done {
+				return err
+			}
+			reterr = err
+			klog.Warningf("request alcub %s failed, attempt %d: %v", u, i+1, reterr)
+		}
+	}
+	// alcubierre may be moved or restarted on new port, the request which
+	// may be reached server is not sent again, only later calls use new url
+	if !policy.redirect {
+		if !policy.passive {
+			c.refreshUrl(dconf, fetchTime)
+		}
+		return reterr
+	}
+	if fetchTime.IsZero() || c.fetchUrl(dconf, fetchTime) != nil {
+		return reterr
+	}
+	if alcuburl, _, _ = dconf.urls(); alcuburl != urls[0] {
+		done, err := c.tryUrl(alcuburl, policy, conf, auth, dconf, fn)
+		if done {
+			return err
+		}
+		reterr = err
+	}
+	return reterr
+}
+
+// return done if success or error is permanent
+func (c *client) tryUrl(u string, policy retryPolicy, conf *AlcubConf, auth http.Header, dconf *DynConf, fn func(ep *endpoint, dc *DynConf) error) (bool, error) {
+	if policy.passive {
+		if c.breaker.Open(u) {
+			return false, fmt.Errorf("circuit of alcub %s is open", u)
+		}
+		err := c.doUrl(u, conf, auth, dconf, fn)
+		return err == nil || permanent(err), err
+	}
+	if !c.breaker.Allow(u) {
+		return false, fmt.Errorf("circuit of alcub %s is open", u)
+	}
+	err := c.doUrl(u, conf, auth, dconf, fn)
+	if err == nil {
+		c.breaker.Success(u)
+		return true, nil
+	}
+	if permanent(err) {
+		c.breaker.Success(u)
+		return true, err
+	}
+	c.breaker.Failure(u)
+	return false, err
+}
+
+// refreshUrl fetch url again in background if it is fetched by client,
+// skipped if url is set by caller or refresh is running
+func (c *client) refreshUrl(dconf *DynConf, seen time.Time) {
+	if seen.IsZero() || !dconf.startRefresh() {
+		return
+	}
+	go func() {
+		defer dconf.endRefresh()
+		_ = c.fetchUrl(dconf, seen)
+	}()
+}
+
+// fetchUrl fetch url which is fetched at seen, the concurrent calls wait
+// and share the result of the first one
+func (c *client) fetchUrl(dconf *DynConf, seen time.Time) error {
+	dconf.fetchmu.Lock()
+	defer dconf.fetchmu.Unlock()
+	if _, _, fetchTime := dconf.urls(); !fetchTime.Equal(seen) {
+		return nil
+	}
+	err := c.fillAlcubUrl(dconf)
+	if err != nil {
+		klog.Errorf("fetch alcub url of node %s failed: %v", dconf.Nodename, err)
+	}
+	return err
+}
+
+func (c *client) doUrl(alcuburl string, conf *AlcubConf, auth http.Header, dconf *DynConf, fn func(ep *endpoint, dc *DynConf) error) error {
+	dst, err := url.Parse(alcuburl)
 	if err != nil {
 		return err
 	}
 	buf := utils.GetBuf()
 	buf.Write(utils.Combine(dst.Scheme, "://"))
-	buf.WriteString(path.Join(dst.Host, c.conf.ApiUrl, resource))
-	err = fn(buf, auth, dconf)
+	buf.WriteString(path.Join(dst.Host, conf.ApiUrl))
+	ep := &endpoint{
+		api:  buf.String(),
+		auth: auth,
+	}
 	utils.PutBuf(buf)
+	return fn(ep, dconf)
+}
 
-	return err
+// endpoint is api url of one alcub server
+type endpoint struct {
+	// scheme://host/apiurl
+	api  string
+	auth http.Header
+}
+
+// send request of operation by the protocol of endpoint,
+// alcub error is returned if http status code is not ok
+func (c *client) send(ep *endpoint, op string, args map[string]string) (*req.Resp, error) {
+	var (
+		proto = c.negotiator.Protocol(ep.api, ep.auth)
+		r     = proto.Request(op, args)
+	)
+	// old server read arguments of get from body only
+	legacyGet := proto.Version() == ApiVersionV1 && r.method == http.MethodGet
+	if legacyGet && c.negotiator.BodyOnGet(ep.api) {
+		r.body = args
+	}
+	resp, err := c.sendRequest(ep, proto, r)
+	if legacyGet && r.body == nil && mtypes.AlcubReasonOf(err) == mtypes.AlcubInvalidArgument &&
+		c.negotiator.FallbackBodyOnGet(ep.api) {
+		r.body = args
+		resp, err = c.sendRequest(ep, proto, r)
+	}
+	return resp, err
+}
+
+func (c *client) sendRequest(ep *endpoint, proto protocol, r *request) (*req.Resp, error) {
+	var vs = []interface{}{ep.auth, defaultHeader}
+	rawurl := strings.TrimSuffix(ep.api, "/") + "/" + r.path
+	if len(r.query) != 0 {
+		rawurl += "?" + r.query.Encode()
+	}
+	if r.body != nil {
+		vs = append(vs, req.BodyJSON(r.body))
+	}
+	klog.V(5).Infof("send %s %s by api %s", r.method, rawurl, proto.Version())
+	resp, err := c.cli.Do(r.method, rawurl, vs...)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	err = checkResp(resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// confOf return client configure overridden by dynamic configure,
+// the secret only replace credential of the configured auth scheme
+func (c *client) confOf(dynconf *DynConf) (*AlcubConf, error) {
+	if dynconf.Conf == nil {
+		return c.conf, nil
+	}
+	conf := *c.conf
+	if v := dynconf.Conf.AlucbPool; v != "" {
+		conf.AlucbPool = v
+	}
+	if v := dynconf.Conf.ApiUrl; v != "" {
+		conf.ApiUrl = v
+	}
+	if v := dynconf.Conf.SecretName; v != "" {
+		conf.User, conf.Password = "", ""
+		conf.Credential = c.secretCredential(dynconf.Conf.SecretNamespace, v)
+		if conf.Auth != nil {
+			auth, err := conf.Auth.WithCredential(conf.Credential)
+			if err != nil {
+				return nil, fmt.Errorf("secret %s/%s can not be used: %v", dynconf.Conf.SecretNamespace, v, err)
+			}
+			conf.Auth = auth
+		}
+	}
+	return &conf, nil
+}
+
+func authOf(conf *AlcubConf) Authenticator {
+	if conf.Auth != nil {
+		return conf.Auth
+	}
+	if conf.Credential != nil {
+		return NewBasicMd5Auth(conf.Credential)
+	}
+	return NewBasicMd5Auth(&staticCredential{
+		user:     conf.User,
+		password: conf.Password,
+	})
 }
 
 func (c *client) fillAlcubUrl(dynconf *DynConf) error {
+	var (
+		alcuburl []byte
+		err      error
+	)
 	attr := fmt.Sprintf("alcubierre_node_%s", dynconf.Nodename)
-	alcuburl, err := rbd2.FetchUrl(c.conf.AlucbPool, attr)
+	pool := c.conf.AlucbPool
+	if dynconf.Conf != nil && dynconf.Conf.AlucbPool != "" {
+		pool = dynconf.Conf.AlucbPool
+	}
+	if cl := dynconf.Cluster; cl != nil {
+		if cl.AlcubPool != "" && (dynconf.Conf == nil || dynconf.Conf.AlucbPool == "") {
+			pool = cl.AlcubPool
+		}
+		alcuburl, err = rbd2.FetchClusterUrl(pool, attr, cl.Monitors, cl.UserId, cl.Key)
+	} else {
+		alcuburl, err = rbd2.FetchUrl(pool, attr)
+	}
 	klog.V(2).Infof("fetch alcub-url: url %s, err:%v", alcuburl, err)
 	if err != nil {
 		return err
 	}
-	dynconf.AlucbUrl = alcuburl
+	alcuburl = bytes.TrimSpace(alcuburl)
+	if len(alcuburl) == 0 {
+		return fmt.Errorf("alcub url of node %s is empty", dynconf.Nodename)
+	}
+	var clusterid string
+	if dynconf.Cluster != nil {
+		clusterid = dynconf.Cluster.ClusterId
+	}
+	if old := dynconf.setUrl(alcuburl); !bytes.Equal(old, alcuburl) {
+		if len(old) != 0 {
+			klog.Infof("alcub url of node %s changed from %s to %s", dynconf.Nodename, old, alcuburl)
+			activeUrl.DeleteLabelValues(dynconf.Nodename, clusterid, string(old))
+		} else {
+			klog.Infof("alcub url of node %s is %s", dynconf.Nodename, alcuburl)
+		}
+	}
+	activeUrl.WithLabelValues(dynconf.Nodename, clusterid, string(alcuburl)).Set(1)
 	return nil
 }
@@ -0,0 +1,171 @@
+package store
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/yylt/csi-alcub/utils"
+)
+
+// type of alcub authentication
+const (
+	AuthBasicMd5 = "basic-md5"
+	AuthToken    = "token"
+	AuthMTLS     = "mtls"
+)
+
+// Authenticator return headers which added into every alcub request,
+// the client certificate of mtls is set by TLS configure
+type Authenticator interface {
+	Header() (http.Header, error)
+	// WithCredential return authenticator of the same scheme which use cred,
+	// error if the scheme does not use username and password
+	WithCredential(cred CredentialSource) (Authenticator, error)
+}
+
+// basicMd5Auth is the legacy scheme which alcub server expect,
+// basic auth with user and hex md5 of password
+type basicMd5Auth struct {
+	cred CredentialSource
+}
+
+func NewBasicMd5Auth(cred CredentialSource) Authenticator {
+	return &basicMd5Auth{cred: cred}
+}
+
+func (a *basicMd5Auth) Header() (http.Header, error) {
+	user, password, err := a.cred.Credential()
+	if err != nil {
+		return nil, err
+	}
+	if user == "" {
+		return nil, nil
+	}
+	return utils.BuildBasicAuthMd5([]byte(user), []byte(password)), nil
+}
+
+func (a *basicMd5Auth) WithCredential(cred CredentialSource) (Authenticator, error) {
+	return NewBasicMd5Auth(cred), nil
+}
+
+// tokenAuth send bearer token which read from file, so it can be rotated
+type tokenAuth struct {
+	cred CredentialSource
+}
+
+func NewTokenAuth(file string, refresh time.Duration) Authenticator {
+	return &tokenAuth{
+		cred: &cachedCredential{
+			name:    file,
+			refresh: refresh,
+			load: func() (string, string, error) {
+				b, err := ioutil.ReadFile(file)
+				if err != nil {
+					return "", "", err
+				}
+				token := strings.TrimSpace(string(b))
+				if token == "" {
+					return "", "", fmt.Errorf("token is empty")
+				}
+				return "", token, nil
+			},
+		},
+	}
+}
+
+func (a *tokenAuth) Header() (http.Header, error) {
+	_, token, err := a.cred.Credential()
+	if err != nil {
+		return nil, err
+	}
+	return http.Header{
+		utils.AuthHead: []string{"Bearer " + token},
+	}, nil
+}
+
+func (a *tokenAuth) WithCredential(CredentialSource) (Authenticator, error) {
+	return nil, fmt.Errorf("username and password is not used by auth type %s", AuthToken)
+}
+
+// mtlsAuth authenticate by client certificate, no header needed
+type mtlsAuth struct{}
+
+func (a mtlsAuth) Header() (http.Header, error) {
+	return nil, nil
+}
+
+func (a mtlsAuth) WithCredential(CredentialSource) (Authenticator, error) {
+	return nil, fmt.Errorf("username and password is not used by auth type %s", AuthMTLS)
+}
+
+// NewTLSConfig return nil if all files are empty, the client certificate
+// is loaded when handshake, so it can be rotated without restart
+func NewTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	conf := &tls.Config{}
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+		conf.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("both client certificate and key must be defined")
+		}
+		_, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, err
+			}
+			return &cert, nil
+		}
+	}
+	return conf, nil
+}
+
+// NewAuthenticator return authenticator by type, cred is used by basic-md5,
+// tokenFile is used by token, and tls must include client certificate for mtls
+func NewAuthenticator(authtype string, cred CredentialSource, tokenFile string, refresh time.Duration, tlsconf *tls.Config) (Authenticator, error) {
+	switch authtype {
+	case "", AuthBasicMd5:
+		return NewBasicMd5Auth(cred), nil
+	case AuthToken:
+		if tokenFile == "" {
+			return nil, fmt.Errorf("token file must be defined when auth type is %s", AuthToken)
+		}
+		return NewTokenAuth(tokenFile, refresh), nil
+	case AuthMTLS:
+		if tlsconf == nil || tlsconf.GetClientCertificate == nil {
+			return nil, fmt.Errorf("client certificate must be defined when auth type is %s", AuthMTLS)
+		}
+		return mtlsAuth{}, nil
+	}
+	return nil, fmt.Errorf("unknown alcub auth type %s", authtype)
+}
+
+// static credential from deprecated flags or storageclass parameters
+type staticCredential struct {
+	user     string
+	password string
+}
+
+func (c *staticCredential) Credential() (string, string, error) {
+	return c.user, c.password, nil
+}
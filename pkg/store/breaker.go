@@ -0,0 +1,90 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	// circuit opened after continuous failures
+	breakerThreshold = 3
+	breakerCooldown  = 30 * time.Second
+)
+
+type circuit struct {
+	failures  int
+	openUntil time.Time
+}
+
+// breaker is circuit breaker of alcub url, so the dead alcub node
+// will not cost every call the full timeout. after cooldown, one
+// call is allowed to check whether alcub recovered.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		circuits:  map[string]*circuit{},
+	}
+}
+
+// Allow return false if circuit of url is open
+func (b *breaker) Allow(url string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ci, ok := b.circuits[url]
+	if !ok || ci.failures < b.threshold {
+		return true
+	}
+	now := time.Now()
+	if now.Before(ci.openUntil) {
+		return false
+	}
+	// half open, other calls wait for the result of this one
+	ci.openUntil = now.Add(b.cooldown)
+	return true
+}
+
+// Open return true if circuit of url is open, the half open
+// call is not taken
+func (b *breaker) Open(url string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ci, ok := b.circuits[url]
+	return ok && ci.failures >= b.threshold && time.Now().Before(ci.openUntil)
+}
+
+func (b *breaker) Success(url string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ci, ok := b.circuits[url]; ok && ci.failures >= b.threshold {
+		klog.Infof("circuit of alcub %s closed", url)
+	}
+	delete(b.circuits, url)
+}
+
+func (b *breaker) Failure(url string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ci, ok := b.circuits[url]
+	if !ok {
+		ci = &circuit{}
+		b.circuits[url] = ci
+	}
+	ci.failures++
+	if ci.failures == b.threshold {
+		klog.Warningf("circuit of alcub %s opened after %d failures", url, ci.failures)
+	}
+	if ci.failures >= b.threshold {
+		ci.openUntil = time.Now().Add(b.cooldown)
+	}
+}
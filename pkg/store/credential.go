@@ -0,0 +1,105 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	klog "k8s.io/klog/v2"
+)
+
+// same keys as secret type kubernetes.io/basic-auth
+const (
+	credentialUserKey     = "username"
+	credentialPasswordKey = "password"
+)
+
+// CredentialSource provide user and password of alcub,
+// which may be rotated while running
+type CredentialSource interface {
+	Credential() (user, password string, err error)
+}
+
+type loadfn func() (user, password string, err error)
+
+// cachedCredential reload credential after refresh interval,
+// the cached credential is used when reload failed
+type cachedCredential struct {
+	name    string
+	refresh time.Duration
+	load    loadfn
+
+	mu       sync.Mutex
+	loadtime time.Time
+	loaded   bool
+	user     string
+	password string
+}
+
+func (c *cachedCredential) Credential() (string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.loaded && time.Since(c.loadtime) < c.refresh {
+		return c.user, c.password, nil
+	}
+	user, password, err := c.load()
+	if err != nil {
+		if c.loaded {
+			klog.Errorf("reload alcub credential from %s failed, use cached: %v", c.name, err)
+			return c.user, c.password, nil
+		}
+		return "", "", fmt.Errorf("load alcub credential from %s failed: %v", c.name, err)
+	}
+	if c.loaded && (user != c.user || password != c.password) {
+		klog.Infof("alcub credential from %s rotated", c.name)
+	}
+	c.user, c.password = user, password
+	c.loaded = true
+	c.loadtime = time.Now()
+	return user, password, nil
+}
+
+// NewFileCredential read username and password files in dir,
+// which is usually a mounted secret
+func NewFileCredential(dir string, refresh time.Duration) CredentialSource {
+	return &cachedCredential{
+		name:    dir,
+		refresh: refresh,
+		load: func() (string, string, error) {
+			user, err := ioutil.ReadFile(filepath.Join(dir, credentialUserKey))
+			if err != nil {
+				return "", "", err
+			}
+			password, err := ioutil.ReadFile(filepath.Join(dir, credentialPasswordKey))
+			if err != nil {
+				return "", "", err
+			}
+			return strings.TrimSpace(string(user)), strings.TrimSpace(string(password)), nil
+		},
+	}
+}
+
+// NewSecretCredential read username and password from secret
+func NewSecretCredential(client kubernetes.Interface, namespace, name string, refresh time.Duration) CredentialSource {
+	return &cachedCredential{
+		name:    namespace + "/" + name,
+		refresh: refresh,
+		load: func() (string, string, error) {
+			secret, err := client.CoreV1().Secrets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			if err != nil {
+				return "", "", err
+			}
+			user, ok := secret.Data[credentialUserKey]
+			if !ok {
+				return "", "", fmt.Errorf("not found %s in secret", credentialUserKey)
+			}
+			return string(user), string(secret.Data[credentialPasswordKey]), nil
+		},
+	}
+}
@@ -7,13 +7,21 @@ type Alcuber interface {
 	// attach, datech bounding to node
 	// Attach is dev_connect
 	// Detach is dev_disconnect
-	DoConn(conf *DynConf, pool, image string) (string, error)
+	DoConn(conf *DynConf, pool, image string, opts *ConnOptions) (string, error)
 	DoDisConn(conf *DynConf, pool, image string) error
-	GetImageStatus(conf *DynConf, pool, image string) bool
+	// return status of image, and error is *types.AlcubError
+	GetImageStatus(conf *DynConf, pool, image string) (string, error)
 	// notice alcuber the node is not ready
 	// because shutdown, network down, etc...
 	FailNode(conf *DynConf, node string) error
 
+	// flush write-back cache of device into ceph, ErrUnsupported
+	// is returned if alcub not support it
+	Flush(conf *DynConf, pool, image string) error
+
+	// cache statistics of device which attached on this node
+	GetDevStats(conf *DynConf, pool, image string) (*DevStats, error)
+
 	// device should be recreate after problem happen
 	// should call when node recover from exception
 	DevStop(conf *DynConf, pool, image string) error
@@ -0,0 +1,241 @@
+package store
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/imroc/req"
+	"k8s.io/apimachinery/pkg/util/sets"
+	klog "k8s.io/klog/v2"
+)
+
+// version of alcub api
+const (
+	ApiVersionAuto = "auto"
+	ApiVersionV1   = "v1"
+	ApiVersionV2   = "v2"
+
+	// path of version negotiation, response: {"versions": ["v1", "v2"], "operations": ["dev_flush"]},
+	// all operations are supported if operations is not answered
+	versionPath = "version"
+)
+
+// operations of alcub
+const (
+	opConnect       = "dev_connect"
+	opDisconnect    = "dev_disconnect"
+	opStop          = "dev_stop"
+	opFlush         = "dev_flush"
+	opNodeFail      = "node_fail"
+	opImageStatus   = "image_status"
+	opSecondaryUrls = "get_secondary_urls"
+	opDevStats      = "dev_stats"
+)
+
+// request of operation, path is relative to api url
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	body   interface{}
+}
+
+// protocol build request of operation
+type protocol interface {
+	Version() string
+	Request(op string, args map[string]string) *request
+}
+
+// legacyProtocol post op and op_args to dev resource,
+// image status is get with pool and image in query, the body is
+// only sent to old server which rejected the query, see negotiator.BodyOnGet
+type legacyProtocol struct{}
+
+func (legacyProtocol) Version() string {
+	return ApiVersionV1
+}
+
+func (legacyProtocol) Request(op string, args map[string]string) *request {
+	if op == opImageStatus {
+		query := url.Values{}
+		for k, v := range args {
+			query.Set(k, v)
+		}
+		return &request{
+			method: http.MethodGet,
+			path:   resource,
+			query:  query,
+		}
+	}
+	return &request{
+		method: http.MethodPost,
+		path:   resource,
+		body: map[string]interface{}{
+			"op":      op,
+			"op_args": args,
+		},
+	}
+}
+
+// restProtocol is rest style api v2
+//  1. POST   v2/devices                          connect, body: pool and image
+//  2. DELETE v2/devices/{pool}/{image}           disconnect
+//  3. POST   v2/devices/{pool}/{image}/stop      stop
+//  4. POST   v2/devices/{pool}/{image}/flush     flush
+//  5. GET    v2/images/{pool}/{image}/status     image status
+//  6. POST   v2/nodes/{node}/fail                node fail
+//  7. GET    v2/nodes/{node}/secondary-urls      secondary urls
+//  8. GET    v2/devices/{pool}/{image}/stats     cache statistics
+type restProtocol struct{}
+
+func (restProtocol) Version() string {
+	return ApiVersionV2
+}
+
+func (restProtocol) Request(op string, args map[string]string) *request {
+	var (
+		pool  = url.PathEscape(args["pool"])
+		image = url.PathEscape(args["image"])
+		node  = url.PathEscape(args["node"])
+	)
+	switch op {
+	case opConnect:
+		return &request{method: http.MethodPost, path: "v2/devices", body: args}
+	case opDisconnect:
+		return &request{method: http.MethodDelete, path: path.Join("v2/devices", pool, image)}
+	case opStop:
+		return &request{method: http.MethodPost, path: path.Join("v2/devices", pool, image, "stop")}
+	case opFlush:
+		return &request{method: http.MethodPost, path: path.Join("v2/devices", pool, image, "flush")}
+	case opImageStatus:
+		return &request{method: http.MethodGet, path: path.Join("v2/images", pool, image, "status")}
+	case opNodeFail:
+		return &request{method: http.MethodPost, path: path.Join("v2/nodes", node, "fail")}
+	case opSecondaryUrls:
+		return &request{method: http.MethodGet, path: path.Join("v2/nodes", node, "secondary-urls")}
+	case opDevStats:
+		return &request{method: http.MethodGet, path: path.Join("v2/devices", pool, image, "stats")}
+	}
+	return legacyProtocol{}.Request(op, args)
+}
+
+// negotiator find protocol of alcub api, the result is cached by api url
+type negotiator struct {
+	cli     *req.Req
+	version string
+
+	mu     sync.Mutex
+	protos map[string]protocol
+	// operations answered by server, key: api url
+	ops map[string]sets.String
+	// legacy api urls which read arguments of get from body
+	getbody map[string]bool
+}
+
+func newNegotiator(cli *req.Req, version string) *negotiator {
+	return &negotiator{
+		cli:     cli,
+		version: version,
+		protos:  map[string]protocol{},
+		ops:     map[string]sets.String{},
+		getbody: map[string]bool{},
+	}
+}
+
+// BodyOnGet return true if the server of api url need arguments of get in body
+func (n *negotiator) BodyOnGet(apiurl string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getbody[apiurl]
+}
+
+// FallbackBodyOnGet record the server of api url need arguments of get in body,
+// return false if it is already recorded
+func (n *negotiator) FallbackBodyOnGet(apiurl string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.getbody[apiurl] {
+		return false
+	}
+	klog.Infof("alcub api %s need arguments of get in body", apiurl)
+	n.getbody[apiurl] = true
+	return true
+}
+
+// Protocol return the protocol of api url, the legacy protocol is used
+// when server not support negotiation. only the explicit answer is cached,
+// so negotiate again after server error or unreachable
+func (n *negotiator) Protocol(apiurl string, auth http.Header) protocol {
+	switch n.version {
+	case ApiVersionV1:
+		return legacyProtocol{}
+	case ApiVersionV2:
+		return restProtocol{}
+	}
+	n.mu.Lock()
+	proto, ok := n.protos[apiurl]
+	n.mu.Unlock()
+	if ok {
+		return proto
+	}
+	proto, ops, ok := n.negotiate(apiurl, auth)
+	if !ok {
+		return proto
+	}
+	klog.Infof("alcub api version of %s is %s, operations: %v", apiurl, proto.Version(), ops)
+	n.mu.Lock()
+	n.protos[apiurl] = proto
+	if ops != nil {
+		n.ops[apiurl] = sets.NewString(ops...)
+	}
+	n.mu.Unlock()
+	return proto
+}
+
+// Supported return false only if the server answered operations without op
+func (n *negotiator) Supported(apiurl string, auth http.Header, op string) bool {
+	if n.version != ApiVersionAuto && n.version != "" {
+		return true
+	}
+	n.Protocol(apiurl, auth)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ops, ok := n.ops[apiurl]
+	return !ok || ops.Has(op)
+}
+
+// negotiate return false if the server not answered the version,
+// operations is nil if not answered
+func (n *negotiator) negotiate(apiurl string, auth http.Header) (protocol, []string, bool) {
+	var verbody = struct {
+		Versions   []string `json:"versions"`
+		Operations []string `json:"operations"`
+	}{}
+	resp, err := n.cli.Get(strings.TrimSuffix(apiurl, "/")+"/"+versionPath, auth, defaultHeader)
+	if err != nil {
+		klog.Errorf("negotiate alcub api version of %s failed: %v", apiurl, err)
+		return legacyProtocol{}, nil, false
+	}
+	switch code := resp.Response().StatusCode; {
+	case code == http.StatusNotFound || code == http.StatusMethodNotAllowed:
+		// old server without version api
+		return legacyProtocol{}, nil, true
+	case code >= http.StatusBadRequest:
+		klog.Errorf("negotiate alcub api version of %s failed: %v", apiurl, checkResp(resp))
+		return legacyProtocol{}, nil, false
+	}
+	// the reply without versions is from old server too
+	err = resp.ToJSON(&verbody)
+	if err != nil {
+		klog.Warningf("invalid alcub api version of %s: %v", apiurl, err)
+	}
+	for _, v := range verbody.Versions {
+		if v == ApiVersionV2 {
+			return restProtocol{}, verbody.Operations, true
+		}
+	}
+	return legacyProtocol{}, verbody.Operations, true
+}
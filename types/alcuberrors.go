@@ -0,0 +1,100 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+)
+
+// reason of alcub error
+type AlcubReason string
+
+const (
+	AlcubNotFound        AlcubReason = "NotFound"
+	AlcubBusy            AlcubReason = "Busy"
+	AlcubUnauthorized    AlcubReason = "Unauthorized"
+	AlcubUnavailable     AlcubReason = "Unavailable"
+	AlcubInvalidArgument AlcubReason = "InvalidArgument"
+	AlcubUnknown         AlcubReason = "Unknown"
+)
+
+// AlcubError is error of alcub api, code is http status code,
+// which is 0 when server unreachable
+type AlcubError struct {
+	Reason  AlcubReason
+	Code    int
+	Message string
+}
+
+func NewAlcubError(reason AlcubReason, code int, msg string) *AlcubError {
+	return &AlcubError{
+		Reason:  reason,
+		Code:    code,
+		Message: msg,
+	}
+}
+
+func (e *AlcubError) Error() string {
+	if e.Code == 0 {
+		return fmt.Sprintf("alcub %s: %s", e.Reason, e.Message)
+	}
+	return fmt.Sprintf("alcub %s(%d): %s", e.Reason, e.Code, e.Message)
+}
+
+// ParseAlcubError parse error by http status code and error message in body,
+// the message is used when code is not enough, such as 200 with error body
+func ParseAlcubError(code int, msg string) *AlcubError {
+	var reason = AlcubUnknown
+	switch {
+	case code == http.StatusBadRequest || code == http.StatusUnprocessableEntity:
+		reason = AlcubInvalidArgument
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		reason = AlcubUnauthorized
+	case code == http.StatusNotFound:
+		reason = AlcubNotFound
+	case code == http.StatusConflict || code == http.StatusLocked:
+		reason = AlcubBusy
+	case code == http.StatusTooManyRequests || code >= http.StatusInternalServerError:
+		reason = AlcubUnavailable
+	}
+	if reason == AlcubUnknown || reason == AlcubUnavailable {
+		lower := strings.ToLower(msg)
+		switch {
+		case strings.Contains(lower, "dirty"), strings.Contains(lower, "busy"), strings.Contains(lower, "in use"):
+			reason = AlcubBusy
+		case strings.Contains(lower, "not found"), strings.Contains(lower, "not exist"):
+			reason = AlcubNotFound
+		}
+	}
+	return NewAlcubError(reason, code, msg)
+}
+
+// AlcubReasonOf return unknown if err is not alcub error
+func AlcubReasonOf(err error) AlcubReason {
+	var aerr *AlcubError
+	if errors.As(err, &aerr) {
+		return aerr.Reason
+	}
+	return AlcubUnknown
+}
+
+// GrpcCode return grpc code of alcub error, so the sidecars retry
+// the right way. internal is returned for other errors
+func GrpcCode(err error) codes.Code {
+	switch AlcubReasonOf(err) {
+	case AlcubNotFound:
+		return codes.NotFound
+	case AlcubBusy:
+		return codes.Aborted
+	case AlcubUnauthorized:
+		return codes.Unauthenticated
+	case AlcubUnavailable:
+		return codes.Unavailable
+	case AlcubInvalidArgument:
+		return codes.InvalidArgument
+	}
+	return codes.Internal
+}
@@ -0,0 +1,5 @@
+package types
+
+// NodeMaintainAnnotation is set to "true" by controller on the node which
+// failed in alcub, the devices on it can be stopped by others
+const NodeMaintainAnnotation = "csi-alcub.io/maintain"
@@ -0,0 +1,57 @@
+package types
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	volumeIdVersion = "v1"
+	volumeIdSep     = ":"
+	// limited by csi spec
+	MaxVolumeIdLen = 128
+)
+
+// VolumeId is self-describing volume id, format is v1:{clusterid}:{pool}:{image}
+// every field is query escaped, so it can be parsed without csialcub.
+// legacy volume id is bare uuid which can not be parsed.
+type VolumeId struct {
+	ClusterId string
+	Pool      string
+	Image     string
+}
+
+func (v *VolumeId) String() string {
+	return strings.Join([]string{
+		volumeIdVersion,
+		url.QueryEscape(v.ClusterId),
+		url.QueryEscape(v.Pool),
+		url.QueryEscape(v.Image),
+	}, volumeIdSep)
+}
+
+func ParseVolumeId(id string) (*VolumeId, error) {
+	var (
+		err    error
+		fields = strings.Split(id, volumeIdSep)
+		values = make([]string, len(fields))
+	)
+	if len(fields) != 4 || fields[0] != volumeIdVersion {
+		return nil, fmt.Errorf("volume id %s is not %s format", id, volumeIdVersion)
+	}
+	for i := 1; i < len(fields); i++ {
+		values[i], err = url.QueryUnescape(fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid volume id %s: %v", id, err)
+		}
+		if values[i] == "" {
+			return nil, fmt.Errorf("invalid volume id %s: empty field", id)
+		}
+	}
+	return &VolumeId{
+		ClusterId: values[1],
+		Pool:      values[2],
+		Image:     values[3],
+	}, nil
+}
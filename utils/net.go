@@ -44,7 +44,7 @@ func BuildBasicAuthMd5(user, pass []byte) http.Header {
 	if len(user) == 0 && len(pass) == 0 {
 		return http.Header{}
 	}
-	//TODO use hex encoder is right?
+	// alcub expect hex encoded md5 of password
 	bearstr := fmt.Sprintf("%s:%x", user, md5.Sum(pass))
 	b64 := base64.StdEncoding.EncodeToString([]byte(bearstr))
 	return http.Header{